@@ -0,0 +1,103 @@
+package s
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// 节点的熔断器，只在本进程中生效，不影响其他调用方
+// 连续失败达到阈值后熔断（open），熔断时间过后放行一个探测请求（half-open），成功后恢复（closed），失败则继续熔断
+type nodeBreaker struct {
+	lock       sync.Mutex
+	state      int
+	failures   int
+	openedTime time.Time
+	probing    bool
+}
+
+// 节点当前是否可以接收请求
+func (nb *nodeBreaker) ready(breakTimeout time.Duration) bool {
+	nb.lock.Lock()
+	defer nb.lock.Unlock()
+	switch nb.state {
+	case breakerOpen:
+		return time.Since(nb.openedTime) >= breakTimeout
+	case breakerHalfOpen:
+		return !nb.probing
+	}
+	return true
+}
+
+// 获取一次请求的许可，熔断时间过后由第一个获取到许可的请求进行探测
+func (nb *nodeBreaker) acquire(breakTimeout time.Duration) bool {
+	nb.lock.Lock()
+	defer nb.lock.Unlock()
+	switch nb.state {
+	case breakerOpen:
+		if time.Since(nb.openedTime) < breakTimeout {
+			return false
+		}
+		nb.state = breakerHalfOpen
+		nb.probing = true
+	case breakerHalfOpen:
+		if nb.probing {
+			return false
+		}
+		nb.probing = true
+	}
+	return true
+}
+
+// 请求成功，返回是否从熔断中恢复
+func (nb *nodeBreaker) succeed() bool {
+	nb.lock.Lock()
+	defer nb.lock.Unlock()
+	recovered := nb.state != breakerClosed
+	nb.state = breakerClosed
+	nb.failures = 0
+	nb.probing = false
+	return recovered
+}
+
+// 请求没有结果（例如调用方取消），归还探测许可，不改变状态
+func (nb *nodeBreaker) release() {
+	nb.lock.Lock()
+	nb.probing = false
+	nb.lock.Unlock()
+}
+
+// 记录节点连续失败的次数，超过 uint8 的范围时保持最大值
+func (node *NodeInfo) setFailedTimes(failedTimes int) {
+	if failedTimes > 255 {
+		failedTimes = 255
+	}
+	node.breaker.lock.Lock()
+	node.FailedTimes = uint8(failedTimes)
+	node.breaker.lock.Unlock()
+}
+
+func (node *NodeInfo) getFailedTimes() uint8 {
+	node.breaker.lock.Lock()
+	defer node.breaker.lock.Unlock()
+	return node.FailedTimes
+}
+
+// 请求失败，返回连续失败次数和是否进入熔断
+func (nb *nodeBreaker) fail(breakFailures int) (int, bool) {
+	nb.lock.Lock()
+	defer nb.lock.Unlock()
+	nb.failures++
+	if nb.state == breakerHalfOpen || (nb.state == breakerClosed && nb.failures >= breakFailures) {
+		nb.state = breakerOpen
+		nb.openedTime = time.Now()
+		nb.probing = false
+		return nb.failures, true
+	}
+	return nb.failures, false
+}
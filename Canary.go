@@ -0,0 +1,39 @@
+package s
+
+import "math/rand"
+
+// 判断本次调用是否使用灰度节点，灰度节点为 Calls 中 canaryApp 应用的节点，或者元数据满足 canaryFilter 的节点
+// 请求头 canaryHeader（默认 X-Canary）为 1 或 0 时强制使用或不使用灰度节点，否则按 canaryPercent 的比例分流
+// canarySticky 时按 SessionId 分配，相同 Session 的请求总是使用相同的版本
+func (caller *Caller) isCanary(app string) bool {
+	appConf := config.Calls[app]
+	if appConf.CanaryApp == "" && appConf.CanaryFilter == "" {
+		return false
+	}
+
+	if caller.request != nil {
+		header := appConf.CanaryHeader
+		if header == "" {
+			header = "X-Canary"
+		}
+		switch caller.request.Header.Get(header) {
+		case "1", "true":
+			return true
+		case "0", "false":
+			return false
+		}
+	}
+
+	if appConf.CanaryPercent <= 0 {
+		return false
+	}
+	if appConf.CanaryPercent >= 100 {
+		return true
+	}
+	if appConf.CanarySticky && caller.request != nil && sessionKey != "" {
+		if sessionId := GetSessionId(caller.request); sessionId != "" {
+			return hashToUnit(sessionId, app)*100 < appConf.CanaryPercent
+		}
+	}
+	return rand.Float64()*100 < appConf.CanaryPercent
+}
@@ -2,11 +2,13 @@ package s
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/mitchellh/mapstructure"
 	"golang.org/x/net/http2"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -17,12 +19,31 @@ import (
 type ClientPool struct {
 	pool          *http.Client
 	globalHeaders map[string]string
+	app           string
+	interceptors  []ClientInterceptor
 }
 
 type Result struct {
 	Error    error
 	Response *http.Response
 	data     []byte
+	body     io.ReadCloser
+	node     string
+}
+
+// 非 2xx 响应的错误，Message 为标准错误内容（{"code": 400, "message": "..."}）中的 message，不是标准错误内容时为响应内容
+type StatusError struct {
+	Code    int
+	Message string
+	Body    []byte
+	Node    string
+}
+
+func (err *StatusError) Error() string {
+	if err.Node != "" {
+		return fmt.Sprintf("STATUS	%d	%s	%s", err.Code, err.Node, err.Message)
+	}
+	return fmt.Sprintf("STATUS	%d	%s", err.Code, err.Message)
 }
 
 func GetClient() *ClientPool {
@@ -64,15 +85,24 @@ func (cp *ClientPool) Head(url string, data interface{}, headers ...string) *Res
 	return cp.Do("HEAD", url, data, headers...)
 }
 func (cp *ClientPool) Do(method, url string, data interface{}, headers ...string) *Result {
+	return cp.DoWithContext(context.Background(), method, url, data, headers...)
+}
+
+// 使用 Context 发起请求，Context 取消或超时时结束请求
+func (cp *ClientPool) DoWithContext(ctx context.Context, method, url string, data interface{}, headers ...string) *Result {
+	return cp.intercept(&ClientRequest{Context: ctx, App: cp.app, Method: method, Url: url, Data: data, Headers: headers}, cp.do)
+}
+
+func (cp *ClientPool) do(request *ClientRequest) *Result {
 	var req *http.Request
 	var err error
-	if data == nil {
-		req, err = http.NewRequest(method, url, nil)
+	if request.Data == nil {
+		req, err = http.NewRequest(request.Method, request.Url, nil)
 	} else {
 		var bytesData []byte
-		bytesData, err = json.Marshal(data)
+		bytesData, err = json.Marshal(request.Data)
 		if err == nil {
-			req, err = http.NewRequest(method, url, bytes.NewReader(bytesData))
+			req, err = http.NewRequest(request.Method, request.Url, bytes.NewReader(bytesData))
 			req.Header.Add("Content-Type", "application/json")
 		}
 	}
@@ -80,15 +110,8 @@ func (cp *ClientPool) Do(method, url string, data interface{}, headers ...string
 		return &Result{Error: err}
 	}
 
-	for k, v := range cp.globalHeaders {
-		req.Header.Add(k, v)
-	}
-
-	for i := 1; i < len(headers); i += 2 {
-		req.Header.Add(headers[i-1], headers[i])
-	}
 	//t1 := time.Now()
-	res, err := cp.pool.Do(req)
+	res, err := cp.send(request.Context, cp.pool, req, request.Headers)
 	//log.Print(" ((((((((((	", url, "	", float32(time.Now().UnixNano()-t1.UnixNano()) / 1e6)
 	if err != nil {
 		return &Result{Error: err}
@@ -104,7 +127,112 @@ func (cp *ClientPool) Do(method, url string, data interface{}, headers ...string
 	return &Result{data: result, Response: res}
 }
 
+// 发起流式请求，body 作为请求内容直接发送（可以为 nil），响应内容不会读取到内存中
+// 返回的结果可以使用 Body() 逐步读取响应内容，读取完成后需要调用 Close()
+func (cp *ClientPool) DoStream(method, url string, body io.Reader, headers ...string) *Result {
+	return cp.DoStreamWithContext(context.Background(), method, url, body, headers...)
+}
+
+// 使用 Context 发起流式请求，Context 取消或超时时结束请求（包括读取响应内容）
+// 客户端的超时时间只限制等待响应头的时间，读取响应内容不受限制
+func (cp *ClientPool) DoStreamWithContext(ctx context.Context, method, url string, body io.Reader, headers ...string) *Result {
+	return cp.intercept(&ClientRequest{Context: ctx, App: cp.app, Method: method, Url: url, Body: body, Stream: true, Headers: headers}, cp.doStream)
+}
+
+func (cp *ClientPool) doStream(request *ClientRequest) *Result {
+	req, err := http.NewRequest(request.Method, request.Url, request.Body)
+	if err != nil {
+		return &Result{Error: err}
+	}
+
+	// http.Client 的 Timeout 包括读取响应内容的时间，流式请求使用没有 Timeout 的副本，改为在收到响应头之前计时
+	ctx, cancel := context.WithCancel(request.Context)
+	streamClient := *cp.pool
+	streamClient.Timeout = 0
+	var timer *time.Timer
+	if cp.pool.Timeout > 0 {
+		timer = time.AfterFunc(cp.pool.Timeout, cancel)
+	}
+	res, err := cp.send(ctx, &streamClient, req, request.Headers)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			res.Body.Close()
+		}
+		cancel()
+		return &Result{Error: fmt.Errorf("Timeout waiting for response headers (%s)", cp.pool.Timeout)}
+	}
+	if err != nil {
+		cancel()
+		return &Result{Error: err}
+	}
+	body := &streamResponseBody{ReadCloser: res.Body, cancel: cancel}
+	res.Body = body
+	return &Result{Response: res, body: body}
+}
+
+// 流式响应的内容，关闭时释放请求使用的 Context
+type streamResponseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *streamResponseBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+func (cp *ClientPool) send(ctx context.Context, client *http.Client, req *http.Request, headers []string) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	for k, v := range cp.globalHeaders {
+		req.Header.Add(k, v)
+	}
+	for i := 1; i < len(headers); i += 2 {
+		req.Header.Add(headers[i-1], headers[i])
+	}
+	return client.Do(req)
+}
+
+// 创建一个结果，可以在拦截器中不发起请求直接返回
+func NewResult(statusCode int, data []byte) *Result {
+	return &Result{Response: &http.Response{StatusCode: statusCode, Status: fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)), Header: http.Header{}}, data: data}
+}
+
+// 流式结果中未读取的响应内容，读取完成后需要调用 Close()，非流式结果返回已读取的内容
+func (rs *Result) Body() io.ReadCloser {
+	if rs.body != nil {
+		return rs.body
+	}
+	return ioutil.NopCloser(bytes.NewReader(rs.data))
+}
+
+// 关闭流式结果的响应内容
+func (rs *Result) Close() error {
+	if rs.body == nil {
+		return nil
+	}
+	err := rs.body.Close()
+	rs.body = nil
+	return err
+}
+
+// 流式结果在使用 String、Bytes、To 等方法时读取全部响应内容
+func (rs *Result) readBody() {
+	if rs.body == nil {
+		return
+	}
+	data, err := ioutil.ReadAll(rs.body)
+	rs.body.Close()
+	rs.body = nil
+	if err != nil {
+		rs.Error = err
+		return
+	}
+	rs.data = data
+}
+
 func (rs *Result) String() string {
+	rs.readBody()
 	if rs.data == nil {
 		return ""
 	}
@@ -112,6 +240,7 @@ func (rs *Result) String() string {
 }
 
 func (rs *Result) Bytes() []byte {
+	rs.readBody()
 	return rs.data
 }
 
@@ -128,6 +257,7 @@ func (rs *Result) Arr() []interface{} {
 }
 
 func (rs *Result) ToAction(result interface{}) string {
+	rs.readBody()
 	var actionStart = -1
 	var actionEnd = -1
 	var resultStart = -1
@@ -164,9 +294,64 @@ func (rs *Result) ToAction(result interface{}) string {
 }
 
 func (rs *Result) To(result interface{}) error {
+	rs.readBody()
 	return convertBytesToObject(rs.data, result)
 }
 
+// 响应的节点（通过 Caller 调用时）
+func (rs *Result) Node() string {
+	return rs.node
+}
+
+// 请求的错误，请求失败时返回 Error，响应不是 2xx 时返回 *StatusError
+func (rs *Result) Err() error {
+	if rs.Error != nil {
+		return rs.Error
+	}
+	if rs.Response == nil {
+		return fmt.Errorf("No Response")
+	}
+	if rs.Response.StatusCode >= 200 && rs.Response.StatusCode < 300 {
+		return nil
+	}
+
+	rs.readBody()
+	statusErr := &StatusError{Code: rs.Response.StatusCode, Body: rs.data, Node: rs.node, Message: string(rs.data)}
+	errorBody := struct {
+		Code    int
+		Message *string
+	}{}
+	if len(rs.data) > 0 && rs.data[0] == '{' && json.Unmarshal(rs.data, &errorBody) == nil && errorBody.Message != nil {
+		statusErr.Message = *errorBody.Message
+	}
+	return statusErr
+}
+
+// 严格的解析，请求失败、响应不是 2xx 或内容不能解析到 result 时返回错误
+// 不做类型转换，包含 result 中不存在的字段或 JSON 之后还有其他内容时也返回错误
+func (rs *Result) StrictTo(result interface{}) error {
+	rs.readBody()
+	if err := rs.Err(); err != nil {
+		return err
+	}
+	if len(rs.data) == 0 {
+		return fmt.Errorf("No Result")
+	}
+	t := reflect.TypeOf(result)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return fmt.Errorf("Bad Result Type	%v", t)
+	}
+	// 不拒绝未知字段，服务端增加返回的字段时不影响调用方
+	decoder := json.NewDecoder(bytes.NewReader(rs.data))
+	if err := decoder.Decode(result); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("Extra Data After Result")
+	}
+	return nil
+}
+
 func convertBytesToObject(data []byte, result interface{}) error {
 	var err error = nil
 	if data == nil {
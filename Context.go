@@ -0,0 +1,58 @@
+package s
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 向下游传递剩余超时时间（毫秒）的请求头
+const timeoutHeader = "S-Timeout"
+
+// 按上游传递的剩余超时时间为请求设置 deadline，服务方法中可以注入 context.Context 获得
+func withRequestDeadline(request *http.Request) (*http.Request, context.CancelFunc) {
+	timeoutStr := request.Header.Get(timeoutHeader)
+	if timeoutStr == "" {
+		return request, nil
+	}
+	timeout, err := strconv.Atoi(timeoutStr)
+	if err != nil || timeout < 0 {
+		return request, nil
+	}
+	ctx, cancel := context.WithTimeout(request.Context(), time.Duration(timeout)*time.Millisecond)
+	return request.WithContext(ctx), cancel
+}
+
+// 使用指定的 Context 调用，替代请求的 Context
+func (caller *Caller) WithContext(ctx context.Context) *Caller {
+	newCaller := *caller
+	newCaller.ctx = ctx
+	return &newCaller
+}
+
+// 调用使用的 Context，优先使用 WithContext 指定的 Context，其次使用请求的 Context（包含上游传递的 deadline）
+func (caller *Caller) Context() context.Context {
+	if caller.ctx != nil {
+		return caller.ctx
+	}
+	if caller.request != nil {
+		return caller.request.Context()
+	}
+	return context.Background()
+}
+
+// 在请求头中添加剩余超时时间，已经超时返回 false
+func appendTimeoutHeader(ctx context.Context, headers []string) ([]string, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return headers, true
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return headers, false
+	}
+	newHeaders := make([]string, len(headers), len(headers)+2)
+	copy(newHeaders, headers)
+	return append(newHeaders, timeoutHeader, strconv.FormatInt(int64(remaining/time.Millisecond), 10)), true
+}
@@ -1,40 +1,86 @@
 package s
 
 import (
+	"context"
 	"fmt"
-	redigo "github.com/garyburd/redigo/redis"
-	"github.com/ssgo/redis"
+	"io"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var dcRedis *redis.Redis
-var isService = false
-var isClient = false
-var syncerRunning = false
-var syncerStopChan = make(chan bool)
-
-var myAddr = ""
-var appNodes = map[string]map[string]*NodeInfo{}
-
-type NodeInfo struct {
-	Addr        string
-	Weight      int
-	UsedTimes   uint64
-	FailedTimes uint8
-	Data        interface{}
-}
+var dcRegistry Registry
+var dcUnwatch func()
+var discoverLock sync.Mutex
+var registeredNodes = map[string]string{}
+var watchingClients = map[string]bool{}
+var watchingApps = map[string]bool{}
 
 var settedLoadBalancer LoadBalancer = &DefaultLoadBalancer{}
-var appSubscribeKeys []interface{}
-var appClientPools = map[string]*ClientPool{}
 
 type Caller struct {
 	headers []string
 	request *http.Request
+	ctx     context.Context
+	hashKey string
+	filter  string
+	prefer  string
+	hedge   time.Duration
+	mock    *Mock
+}
+
+// 使用指定的 Key 进行一致性哈希，相同 Key 的请求总是发送到同一个节点
+func (caller *Caller) WithKey(key string) *Caller {
+	newCaller := *caller
+	newCaller.hashKey = key
+	return &newCaller
+}
+
+// 只使用元数据满足条件的节点，例如 c.WithFilter("version=2.*")，替代 Calls 中配置的 filter
+func (caller *Caller) WithFilter(conditions string) *Caller {
+	newCaller := *caller
+	newCaller.filter = conditions
+	return &newCaller
+}
+
+// 优先使用元数据满足条件的节点，没有可用节点时再使用其他节点，例如 c.WithPrefer("zone=$zone")，替代 Calls 中配置的 prefer
+func (caller *Caller) WithPrefer(conditions string) *Caller {
+	newCaller := *caller
+	newCaller.prefer = conditions
+	return &newCaller
+}
+
+// 获取节点的过滤和优先条件，优先使用 WithFilter、WithPrefer 指定的条件
+func (caller *Caller) getMetaConditions(app string) (filter, prefer metaConditions) {
+	appConf := config.Calls[app]
+	filterStr, preferStr := caller.filter, caller.prefer
+	if filterStr == "" {
+		filterStr = appConf.Filter
+	}
+	if preferStr == "" {
+		preferStr = appConf.Prefer
+	}
+	return parseMetaConditions(filterStr), parseMetaConditions(preferStr)
+}
+
+// 获取一致性哈希使用的 Key，优先使用 WithKey 指定的 Key，其次根据配置使用 SessionId 或请求头
+func (caller *Caller) getHashKey(app string) string {
+	if caller.hashKey != "" {
+		return caller.hashKey
+	}
+	if caller.request == nil {
+		return ""
+	}
+	appConf := config.Calls[app]
+	if appConf.HashSession && sessionKey != "" {
+		return GetSessionId(caller.request)
+	}
+	if appConf.HashHeader != "" {
+		return caller.request.Header.Get(appConf.HashHeader)
+	}
+	return ""
 }
 
 func (caller *Caller) Get(app, path string, headers ...string) *Result {
@@ -56,17 +102,22 @@ func (caller *Caller) Do(method, app, path string, data interface{}, headers ...
 	r, _ := caller.DoWithNode(method, app, "", path, data, headers...)
 	return r
 }
-func (caller *Caller) DoWithNode(method, app, withNode, path string, data interface{}, headers ...string) (*Result, string) {
-	if appNodes[app] == nil {
-		log.Printf("DISCOVER	No App	%s	%s", app, path)
-		return &Result{Error: fmt.Errorf("CALL	%s	%s	not exists", app, path)}, ""
-	}
-	if len(appNodes[app]) == 0 {
-		log.Printf("DISCOVER	No Node	%s	%s	%d", app, path, len(appNodes[app]))
-		return &Result{Error: fmt.Errorf("CALL	%s	%s	No node avaliable	(%d)", app, path, len(appNodes[app]))}, ""
-	}
 
+// 流式调用的请求内容
+type streamBody struct {
+	reader io.Reader
+}
+
+// 流式调用，body 直接作为请求内容发送（可以为 nil），返回的结果可以使用 Body() 逐步读取响应内容，读取完成后需要调用 Close()
+// 流式调用不会发出对冲请求，有请求内容时也不会重试
+func (caller *Caller) DoStream(method, app, path string, body io.Reader, headers ...string) *Result {
+	r, _ := caller.DoWithNode(method, app, "", path, &streamBody{reader: body}, headers...)
+	return r
+}
+
+func (caller *Caller) DoWithNode(method, app, withNode, path string, data interface{}, headers ...string) (*Result, string) {
 	appConf := config.Calls[app]
+
 	if headers == nil {
 		headers = []string{}
 	}
@@ -75,71 +126,239 @@ func (caller *Caller) DoWithNode(method, app, withNode, path string, data interf
 	}
 	headers = append(headers, caller.headers...)
 
+	// 使用 Mock 时不发起请求
+	if mock := caller.getMock(); mock != nil {
+		return mock.do(method, app, path, data, headers), ""
+	}
+
+	// 灰度分流，灰度应用的节点都不可用时使用正常的节点
+	isCanary := caller.isCanary(app)
+	canaryFilter := parseMetaConditions(appConf.CanaryFilter)
+	var canaryNodes map[string]*NodeInfo
+	if isCanary && appConf.CanaryApp != "" {
+		canaryNodes = getAppNodes(appConf.CanaryApp)
+	}
+
+	// 本次调用始终使用同一份节点快照
+	appNodes := getAppNodes(app)
+	if appNodes == nil && len(canaryNodes) == 0 {
+		log.Printf("DISCOVER	No App	%s	%s", app, path)
+		return &Result{Error: fmt.Errorf("CALL	%s	%s	not exists", app, path)}, ""
+	}
+	if len(appNodes) == 0 && len(canaryNodes) == 0 {
+		log.Printf("DISCOVER	No Node	%s	%s	%d", app, path, len(appNodes))
+		return &Result{Error: fmt.Errorf("CALL	%s	%s	No node avaliable	(%d)", app, path, len(appNodes))}, ""
+	}
+
+	breakFailures := appConf.BreakFailures
+	if breakFailures <= 0 {
+		breakFailures = 3
+	}
+	breakTimeout := time.Duration(appConf.BreakTimeout) * time.Millisecond
+	if breakTimeout <= 0 {
+		breakTimeout = 10 * time.Second
+	}
+
+	lb := getLoadBalancer(app)
+	hashKey := caller.getHashKey(app)
+	filter, prefer := caller.getMetaConditions(app)
+	var keyLb KeyLoadBalancer
+	if hashKey != "" {
+		keyLb, _ = lb.(KeyLoadBalancer)
+		if keyLb == nil {
+			keyLb = defaultKeyLoadBalancer
+		}
+	}
+
+	retry := getRetryPolicy(app)
+	retry.budget.deposit()
+	attempts := 0
+	hedge := getHedgePolicy(app)
+	hedgeDelay := caller.getHedgeDelay(hedge, retry, method, headers)
+	if stream, isStream := data.(*streamBody); isStream {
+		hedgeDelay = 0
+		if stream.reader != nil {
+			retry = &retryPolicy{maxAttempts: 1}
+		}
+	}
+
 	var r *Result
 	excludes := make(map[string]bool)
+
+	availableNodes := func(fromNodes map[string]*NodeInfo) []*NodeInfo {
+		nodes := []*NodeInfo{}
+		for _, node := range fromNodes {
+			if excludes[node.Addr] || !node.IsHealthy() || !node.breaker.ready(breakTimeout) || !filter.match(node.Meta) {
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+		return nodes
+	}
+
+	// 从可用的节点中选择一个，选过的节点本次调用中不再使用，优先使用灰度应用的节点
+	nextNode := func() *NodeInfo {
+		nodes := availableNodes(canaryNodes)
+		if len(nodes) == 0 {
+			nodes = availableNodes(appNodes)
+			if canaryFilter != nil {
+				nodes = canaryFilter.prefer(nodes, isCanary)
+			}
+		}
+		if prefer != nil {
+			nodes = prefer.prefer(nodes, true)
+		}
+		if len(nodes) == 0 {
+			return nil
+		}
+		var node *NodeInfo
+		if keyLb != nil {
+			node = keyLb.NextByKey(nodes, hashKey)
+		} else {
+			node = lb.Next(nodes, caller.request)
+		}
+		excludes[node.Addr] = true
+		return node
+	}
+
+	ctx := caller.Context()
+	callStartTime := time.Now()
 	for {
+		// 调用方已经取消或超时，不再尝试其他节点
+		callHeaders, ok := appendTimeoutHeader(ctx, headers)
+		if ctx.Err() != nil || !ok {
+			err := ctx.Err()
+			if err == nil {
+				err = context.DeadlineExceeded
+			}
+			log.Printf("DISCOVER	Canceled	%s	%s	%s", app, path, err)
+			return &Result{Error: err}, ""
+		}
+
 		var node *NodeInfo
 		if withNode != "" {
-			node = appNodes[app][withNode]
+			node = appNodes[withNode]
+			if node == nil {
+				node = canaryNodes[withNode]
+			}
 			excludes[withNode] = true
 			withNode = ""
 		}
 
 		if node == nil {
-			nodes := []*NodeInfo{}
-			for _, node := range appNodes[app] {
-				if excludes[node.Addr] || node.FailedTimes >= 3 {
-					continue
-				}
-				nodes = append(nodes, node)
-			}
-			if len(nodes) > 0 {
-				node = settedLoadBalancer.Next(nodes, caller.request)
-				excludes[node.Addr] = true
-			}
+			node = nextNode()
+		}
+		if node == nil && r != nil && len(excludes) > 0 && attempts < retry.maxAttempts {
+			// 重试次数多于可用节点时，重新从全部节点中选择
+			excludes = make(map[string]bool)
+			continue
 		}
 		if node == nil {
-			log.Printf("DISCOVER	No Node	%s	%s	%d", app, path, len(appNodes[app]))
+			log.Printf("DISCOVER	No Node	%s	%s	%d", app, path, len(appNodes))
 			break
 		}
 
-		// 请求节点
-		startTime := time.Now()
-		node.UsedTimes++
-		r = appClientPools[app].Do(method, fmt.Sprintf("http://%s%s", node.Addr, path), data, headers...)
-		settedLoadBalancer.Response(node, r.Error, r.Response, startTime.UnixNano()-time.Now().UnixNano())
-
-		if r.Error != nil || r.Response.StatusCode == 502 || r.Response.StatusCode == 503 || r.Response.StatusCode == 504 {
-			log.Printf("DISCOVER	Failed	%s	%s	%d	%d	%d	%d	%s", node.Addr, path, node.Weight, node.UsedTimes, node.FailedTimes, r.Response.StatusCode, r.Error)
-			// 错误处理
-			node.FailedTimes++
-			if node.FailedTimes >= 3 {
-				log.Printf("DISCOVER	Removed	%s	%s	%d	%d	%d	%d	%s", node.Addr, path, node.Weight, node.UsedTimes, node.FailedTimes, r.Response.StatusCode, r.Error)
-				if dcRedis.HDEL(config.RegistryPrefix+app, node.Addr) > 0 {
-					dcRedis.Do("PUBLISH", config.RegistryPrefix+"CH_"+config.App, fmt.Sprintf("%s %d", node.Addr, 0))
+		// 熔断中的节点，或者半开状态下已经有探测请求
+		if !node.breaker.acquire(breakTimeout) {
+			continue
+		}
+
+		// 请求节点，开启对冲时节点响应慢会再请求另一个节点
+		var usedTimes uint64
+		var responseTimeing int64
+		if hedgeDelay > 0 {
+			node, r, usedTimes, responseTimeing = doHedgedCall(ctx, app, lb, node, hedgeDelay, func() *NodeInfo {
+				hedgeNode := nextNode()
+				if hedgeNode == nil || !hedgeNode.breaker.acquire(breakTimeout) {
+					return nil
 				}
+				return hedgeNode
+			}, method, path, data, callHeaders)
+		} else {
+			r, usedTimes, responseTimeing = callNode(ctx, app, node, method, path, data, callHeaders)
+		}
+		lb.Response(node, r.Error, r.Response, responseTimeing)
+
+		// 调用方取消或超时导致的失败不计入节点的熔断
+		if r.Error != nil && ctx.Err() != nil {
+			node.breaker.release()
+			log.Printf("DISCOVER	Canceled	%s	%s	%s", node.Addr, path, ctx.Err())
+			return &Result{Error: ctx.Err()}, node.Addr
+		}
+
+		statusCode := 0
+		if r.Response != nil {
+			statusCode = r.Response.StatusCode
+		}
+		if r.Error != nil || statusCode == 502 || statusCode == 503 || statusCode == 504 {
+			// 错误处理，连续失败达到阈值后在本进程中熔断该节点
+			failedTimes, isBroken := node.breaker.fail(breakFailures)
+			node.setFailedTimes(failedTimes)
+			log.Printf("DISCOVER	Failed	%s	%s	%d	%d	%d	%d	%s", node.Addr, path, node.Weight, usedTimes, failedTimes, statusCode, r.Error)
+			if isBroken {
+				log.Printf("DISCOVER	Break	%s	%s	%d	%d	%d	%d	%s", node.Addr, path, node.Weight, usedTimes, failedTimes, statusCode, r.Error)
 			}
 		} else {
-			// 成功
+			// 成功，对冲延迟使用调用方从第一次请求开始等待的时间，而不是对冲后先返回的请求自身的耗时
+			hedge.record(time.Now().UnixNano() - callStartTime.UnixNano())
+			node.setFailedTimes(0)
+			if node.breaker.succeed() {
+				log.Printf("DISCOVER	Recover	%s	%s	%d	%d", node.Addr, path, node.Weight, usedTimes)
+			}
+		}
+
+		// 根据重试策略决定是否重试，不重试时返回本次的结果
+		if !retry.retryable(method, callHeaders, r.Error, statusCode) {
+			return r, node.Addr
+		}
+		attempts++
+		if retry.maxAttempts > 0 && attempts >= retry.maxAttempts {
+			log.Printf("DISCOVER	Retry Exhausted	%s	%s	%d	%d	%s", app, path, attempts, statusCode, r.Error)
 			return r, node.Addr
 		}
+		if !retry.budget.withdraw() {
+			log.Printf("DISCOVER	Retry Budget	%s	%s	%d	%d	%s", app, path, attempts, statusCode, r.Error)
+			return r, node.Addr
+		}
+		r.Close()
+		retry.wait(ctx, attempts)
 	}
 
 	// 全部失败，返回最后一个失败的结果
-	return &Result{Error: fmt.Errorf("CALL	%s	%s	No node avaliable	(%d)", app, path, len(appNodes[app]))}, ""
+	return &Result{Error: fmt.Errorf("CALL	%s	%s	No node avaliable	(%d)", app, path, len(appNodes))}, ""
 }
 
+// 请求一个节点，返回结果、节点的使用次数和耗时（纳秒）
+func callNode(ctx context.Context, app string, node *NodeInfo, method, path string, data interface{}, headers []string) (*Result, uint64, int64) {
+	startTime := time.Now()
+	usedTimes := atomic.AddUint64(&node.UsedTimes, 1)
+	atomic.AddInt64(&node.Requesting, 1)
+	var r *Result
+	if stream, isStream := data.(*streamBody); isStream {
+		r = getClientPool(app).DoStreamWithContext(ctx, method, fmt.Sprintf("http://%s%s", node.Addr, path), stream.reader, headers...)
+	} else {
+		r = getClientPool(app).DoWithContext(ctx, method, fmt.Sprintf("http://%s%s", node.Addr, path), data, headers...)
+	}
+	atomic.AddInt64(&node.Requesting, -1)
+	r.node = node.Addr
+	return r, usedTimes, time.Now().UnixNano() - startTime.UnixNano()
+}
+
+// 启动服务发现，同一进程中可以启动多个服务，共用一个注册中心和节点信息
 func startDiscover(addr string) bool {
-	myAddr = addr
-	isService = config.App != "" && config.Weight > 0
-	isClient = len(config.Calls) > 0
-	if isService || isClient {
-		dcRedis = redis.GetRedis(config.Registry)
-		if dcRedis.Error != nil {
+	isService := config.App != "" && config.Weight > 0
+	isClient := len(config.Calls) > 0
+	if !isService && !isClient {
+		return true
+	}
+
+	discoverLock.Lock()
+	defer discoverLock.Unlock()
+	if dcRegistry == nil {
+		dcRegistry = makeRegistry()
+		if dcRegistry == nil {
 			return false
 		}
-	} else {
-		return true
 	}
 
 	isok := true
@@ -154,9 +373,14 @@ func startDiscover(addr string) bool {
 		}
 
 		// 注册节点
-		if dcRedis.HSET(config.RegistryPrefix+config.App, addr, config.Weight) {
+		// 复制元数据，重新加载配置时不影响已注册的节点
+		meta := make(map[string]string, len(config.Meta))
+		for k, v := range config.Meta {
+			meta[k] = v
+		}
+		if dcRegistry.Register(config.App, addr, &RegistryNode{Weight: int(config.Weight), Meta: meta}) {
+			registeredNodes[addr] = config.App
 			log.Printf("DISCOVER	Registered	%s	%s	%d", config.App, addr, config.Weight)
-			dcRedis.Do("PUBLISH", config.RegistryPrefix+"CH_"+config.App, fmt.Sprintf("%s %d", addr, config.Weight))
 		} else {
 			isok = false
 			log.Printf("DISCOVER	Register failed	%s	%s	%d", config.App, addr, config.Weight)
@@ -164,9 +388,16 @@ func startDiscover(addr string) bool {
 	}
 
 	if isClient {
-		syncerRunning = true
+		hasNewApp := false
 		for app, conf := range config.Calls {
-			appSubscribeKeys = append(appSubscribeKeys, config.RegistryPrefix+"CH_"+app)
+			if !watchingApps[app] {
+				watchingApps[app] = true
+				hasNewApp = true
+			}
+			if conf.CanaryApp != "" && !watchingApps[conf.CanaryApp] {
+				watchingApps[conf.CanaryApp] = true
+				hasNewApp = true
+			}
 
 			var cp *ClientPool
 			if conf.HttpVersion == 1 {
@@ -177,151 +408,64 @@ func startDiscover(addr string) bool {
 			if conf.Timeout > 0 {
 				cp.pool.Timeout = time.Duration(conf.Timeout) * time.Millisecond
 			}
-			appClientPools[app] = cp
+			cp.app = app
+			cp.addNamedInterceptors(conf.Interceptors)
+			setClientPool(app, cp)
+			setLoadBalancer(app, makeLoadBalancer(conf.LoadBalancer))
+			setRetryPolicy(app, makeRetryPolicy(conf.RetryTimes, conf.RetryMethods, conf.RetryStatus, conf.RetryBackoff, conf.RetryMaxBackoff, conf.RetryBudget))
+			setHedgePolicy(app, makeHedgePolicy(conf.HedgeDelay, conf.HedgePercentile))
 		}
-		initedChan := make(chan bool)
-		go syncDiscover(initedChan)
-		<-initedChan
-	}
-	return isok
-}
 
-var syncConn *redigo.PubSubConn
-
-func syncDiscover(initedChan chan bool) {
-	inited := false
-	for {
-		syncConn = &redigo.PubSubConn{Conn: dcRedis.GetConnection()}
-		err := syncConn.Subscribe(appSubscribeKeys...)
-		if err != nil {
-			log.Print("REDIS SUBSCRIBE	", err)
-			syncConn.Close()
-			syncConn = nil
-
-			if !inited {
-				inited = true
-				initedChan <- true
-			}
-			time.Sleep(time.Second * 1)
-			if !syncerRunning {
-				break
-			}
-			continue
-		}
-
-		// 第一次或断线后重新获取（订阅开始后再获取全量确保信息完整）
-		for app, _ := range config.Calls {
-			if appNodes[app] == nil {
-				appNodes[app] = map[string]*NodeInfo{}
-			}
-
-			appResults := dcRedis.Do("HGETALL", config.RegistryPrefix+app).ResultMap()
-			for _, node := range appNodes[app] {
-				if appResults[node.Addr] == nil {
-					log.Printf("DISCOVER	Remove When Reset	%s	%s	%d", app, node.Addr, 0)
-					pushNode(app, node.Addr, 0)
-				}
-			}
-			for addr, weightResult := range appResults {
-				weight := weightResult.Int()
-				log.Printf("DISCOVER	Reset	%s	%s	%d", app, addr, weight)
-				pushNode(app, addr, weight)
-			}
-		}
-		if !inited {
-			inited = true
-			initedChan <- true
-		}
-		if !syncerRunning {
-			break
-		}
-
-		// 开始接收订阅数据
-		for {
-			isErr := false
-			switch v := syncConn.Receive().(type) {
-			case redigo.Message:
-				a := strings.Split(string(v.Data), " ")
-				addr := a[0]
-				weight := 0
-				if len(a) == 2 {
-					weight, _ = strconv.Atoi(a[1])
-				}
-				app := strings.Replace(v.Channel, config.RegistryPrefix+"CH_", "", 1)
-				log.Printf("DISCOVER	Received	%s	%s	%d", app, addr, weight)
-				pushNode(app, addr, weight)
-			case redigo.Subscription:
-			case error:
-				if !strings.Contains(v.Error(), "connection closed") {
-					log.Printf("REDIS RECEIVE ERROR	%s", v)
-				}
-				isErr = true
-				break
+		// 有新的应用时重新开始监听
+		if hasNewApp || len(watchingClients) == 0 {
+			if dcUnwatch != nil {
+				dcUnwatch()
 			}
-			if isErr {
-				break
+			apps := make([]string, 0, len(watchingApps))
+			for app := range watchingApps {
+				apps = append(apps, app)
 			}
+			dcUnwatch = dcRegistry.Watch(apps, resetNodes, receiveNode)
+			startHealthChecker()
 		}
-		if !syncerRunning {
-			break
-		}
-		time.Sleep(time.Second * 1)
-		if !syncerRunning {
-			break
-		}
-	}
-
-	if syncConn != nil {
-		syncConn.Unsubscribe(appSubscribeKeys)
-		syncConn.Close()
-		syncConn = nil
+		watchingClients[addr] = true
 	}
-
-	syncerStopChan <- true
+	return isok
 }
 
-func pushNode(app, addr string, weight int) {
-	if weight == 0 {
-		// 删除节点
-		if appNodes[app][addr] != nil {
-			delete(appNodes[app], addr)
-		}
-	} else if appNodes[app][addr] == nil {
-		// 新节点
-		var avgScore float64 = 0
-		for _, node := range appNodes[app] {
-			avgScore = float64(node.UsedTimes) / float64(weight)
+// 注销节点，停止服务时最先执行，确保调用方不再发送新的请求
+func unregisterDiscover(addr string) {
+	discoverLock.Lock()
+	defer discoverLock.Unlock()
+	app := registeredNodes[addr]
+	if app != "" {
+		delete(registeredNodes, addr)
+		if dcRegistry.Unregister(app, addr) {
+			log.Printf("DISCOVER	Unregistered	%s	%s	%d", app, addr, 0)
 		}
-		usedTimes := uint64(avgScore) * uint64(weight)
-		appNodes[app][addr] = &NodeInfo{Addr: addr, Weight: weight, UsedTimes: usedTimes}
-	} else if appNodes[app][addr].Weight != weight {
-		// 修改权重
-		node := appNodes[app][addr]
-		node.Weight = weight
-		node.UsedTimes = uint64(float64(node.UsedTimes) / float64(node.Weight) * float64(weight))
 	}
+	releaseRegistry()
 }
 
-func stopDiscover() {
-	if isClient {
-		syncerRunning = false
-		if syncConn != nil {
-			syncConn.Unsubscribe(appSubscribeKeys)
-			syncConn.Close()
-			syncConn = nil
-		}
-	}
-
-	if isService {
-		if dcRedis.HDEL(config.RegistryPrefix+config.App, myAddr) > 0 {
-			log.Printf("DISCOVER	Unregistered	%s	%s	%d", config.App, myAddr, 0)
-			dcRedis.Do("PUBLISH", config.RegistryPrefix+"CH_"+config.App, fmt.Sprintf("%s	%d", myAddr, 0))
+// 停止监听节点变化，最后一个服务停止后结束监听
+func stopDiscover(addr string) {
+	discoverLock.Lock()
+	defer discoverLock.Unlock()
+	if watchingClients[addr] {
+		delete(watchingClients, addr)
+		if len(watchingClients) == 0 {
+			stopHealthChecker()
+			dcUnwatch()
+			dcUnwatch = nil
+			watchingApps = map[string]bool{}
 		}
 	}
+	releaseRegistry()
 }
 
-func waitDiscover() {
-	if isClient {
-		<-syncerStopChan
+// 没有注册和监听时释放注册中心，下次启动时根据配置重新创建
+func releaseRegistry() {
+	if len(registeredNodes) == 0 && len(watchingClients) == 0 {
+		dcRegistry = nil
 	}
 }
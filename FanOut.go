@@ -0,0 +1,49 @@
+package s
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 并发调用中的一个请求
+type Call struct {
+	Method  string
+	App     string
+	Path    string
+	Data    interface{}
+	Headers []string
+}
+
+// 并发发起多个调用，按 calls 的顺序返回结果，请求头（S-Unique-Id、Access-Token 等）与单独调用时相同
+// timeout 为全部调用的超时时间（0 表示只使用 Caller 的 Context），failFast 时任意一个调用失败（Error 或状态码 >= 500）后取消其他未完成的调用
+func (caller *Caller) DoAll(timeout time.Duration, failFast bool, calls ...Call) []*Result {
+	ctx, cancel := context.WithCancel(caller.Context())
+	defer cancel()
+	if timeout > 0 {
+		var timeoutCancel context.CancelFunc
+		ctx, timeoutCancel = context.WithTimeout(ctx, timeout)
+		defer timeoutCancel()
+	}
+	ctxCaller := caller.WithContext(ctx)
+
+	results := make([]*Result, len(calls))
+	var wg sync.WaitGroup
+	for i, call := range calls {
+		wg.Add(1)
+		go func(i int, call Call) {
+			defer wg.Done()
+			method := call.Method
+			if method == "" {
+				method = "GET"
+			}
+			r := ctxCaller.Do(method, call.App, call.Path, call.Data, call.Headers...)
+			results[i] = r
+			if failFast && (r.Error != nil || (r.Response != nil && r.Response.StatusCode >= 500)) {
+				cancel()
+			}
+		}(i, call)
+	}
+	wg.Wait()
+	return results
+}
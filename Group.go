@@ -0,0 +1,97 @@
+package s
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+)
+
+// 路由分组，组内的路由使用相同的路径前缀、默认的认证级别和只对组内生效的过滤器，分组可以嵌套
+type Group struct {
+	parent     *Group
+	prefix     string
+	authLevel  uint
+	inFilters  []func(*map[string]interface{}, *http.Request, *http.ResponseWriter) interface{}
+	outFilters []func(*map[string]interface{}, *http.Request, *http.ResponseWriter, interface{}) (interface{}, bool)
+}
+
+// 创建路由分组，authLevel 为组内路由的默认认证级别（注册时认证级别为 0 的路由使用）
+func NewGroup(prefix string, authLevel uint) *Group {
+	return &Group{prefix: prefix, authLevel: authLevel}
+}
+
+// 创建下级分组，路径前缀接在上级分组之后，authLevel 为 0 时使用上级分组的认证级别，上级分组的过滤器同样生效
+func (group *Group) Group(prefix string, authLevel uint) *Group {
+	if authLevel == 0 {
+		authLevel = group.authLevel
+	}
+	return &Group{parent: group, prefix: group.prefix + prefix, authLevel: authLevel}
+}
+
+// 设置分组的前置过滤器，在全局的前置过滤器之后执行
+func (group *Group) SetInFilter(filter func(in *map[string]interface{}, request *http.Request, response *http.ResponseWriter) (out interface{})) {
+	group.inFilters = append(group.inFilters, filter)
+}
+
+// 设置分组的后置过滤器，在全局的后置过滤器之前执行
+func (group *Group) SetOutFilter(filter func(in *map[string]interface{}, request *http.Request, response *http.ResponseWriter, out interface{}) (newOut interface{}, isOver bool)) {
+	group.outFilters = append(group.outFilters, filter)
+}
+
+// 在分组中注册服务
+func (group *Group) Register(authLevel uint, path string, serviceFunc interface{}) {
+	registerWebService(group, "", group.getAuthLevel(authLevel), group.prefix+path, serviceFunc)
+}
+
+// 在分组中注册指定请求方法的服务
+func (group *Group) RegisterByMethod(method string, authLevel uint, path string, serviceFunc interface{}) {
+	registerWebService(group, method, group.getAuthLevel(authLevel), group.prefix+path, serviceFunc)
+}
+
+// 在分组中注册Websocket服务
+func (group *Group) RegisterWebsocket(authLevel uint, path string, updater *websocket.Upgrader,
+	onOpen interface{},
+	onClose interface{},
+	decoder func(data interface{}) (action string, request *map[string]interface{}, err error),
+	encoder func(action string, data interface{}) interface{}) *ActionRegister {
+	return registerWebsocket(group, group.getAuthLevel(authLevel), group.prefix+path, updater, onOpen, onClose, decoder, encoder)
+}
+
+// 在分组中添加代理，与全局的 Proxy 不同，分组中的代理会按认证级别进行身份认证
+func (group *Group) Proxy(authLevel uint, path string, toApp, toPath string) {
+	addProxy(group, group.getAuthLevel(authLevel), group.prefix+path, toApp, toPath)
+}
+
+func (group *Group) getAuthLevel(authLevel uint) uint {
+	if authLevel == 0 {
+		return group.authLevel
+	}
+	return authLevel
+}
+
+// 请求使用的前置过滤器，先执行全局的，再由外到内执行分组的
+func (group *Group) getInFilters() []func(*map[string]interface{}, *http.Request, *http.ResponseWriter) interface{} {
+	if group == nil {
+		return inFilters
+	}
+	parentFilters := group.parent.getInFilters()
+	if len(group.inFilters) == 0 {
+		return parentFilters
+	}
+	filters := make([]func(*map[string]interface{}, *http.Request, *http.ResponseWriter) interface{}, 0, len(parentFilters)+len(group.inFilters))
+	filters = append(filters, parentFilters...)
+	return append(filters, group.inFilters...)
+}
+
+// 请求使用的后置过滤器，先由内到外执行分组的，再执行全局的
+func (group *Group) getOutFilters() []func(*map[string]interface{}, *http.Request, *http.ResponseWriter, interface{}) (interface{}, bool) {
+	if group == nil {
+		return outFilters
+	}
+	parentFilters := group.parent.getOutFilters()
+	if len(group.outFilters) == 0 {
+		return parentFilters
+	}
+	filters := make([]func(*map[string]interface{}, *http.Request, *http.ResponseWriter, interface{}) (interface{}, bool), 0, len(parentFilters)+len(group.outFilters))
+	filters = append(filters, group.outFilters...)
+	return append(filters, parentFilters...)
+}
@@ -0,0 +1,99 @@
+package s
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 节点的健康状态，由主动健康检查更新
+type nodeHealth struct {
+	failures  int32
+	unhealthy int32
+}
+
+// 节点是否健康，未开启健康检查时始终为 true
+func (node *NodeInfo) IsHealthy() bool {
+	return node.health == nil || atomic.LoadInt32(&node.health.unhealthy) == 0
+}
+
+var healthCheckerStopChan chan bool
+
+// 对开启了健康检查（HealthInterval > 0）的应用定时探测所有节点
+func startHealthChecker() {
+	stopHealthChecker()
+	stopChan := make(chan bool)
+	for app, conf := range config.Calls {
+		if conf.HealthInterval <= 0 {
+			continue
+		}
+		path := conf.HealthPath
+		if path == "" {
+			path = config.HealthPath
+		}
+		failures := conf.HealthFailures
+		if failures <= 0 {
+			failures = 3
+		}
+		go checkAppHealth(app, path, time.Duration(conf.HealthInterval)*time.Millisecond, failures, stopChan)
+	}
+	healthCheckerStopChan = stopChan
+}
+
+func stopHealthChecker() {
+	if healthCheckerStopChan != nil {
+		close(healthCheckerStopChan)
+		healthCheckerStopChan = nil
+	}
+}
+
+func checkAppHealth(app, path string, interval time.Duration, failures int, stopChan chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			var wg sync.WaitGroup
+			for _, node := range getAppNodes(app) {
+				wg.Add(1)
+				go func(node *NodeInfo) {
+					defer wg.Done()
+					checkNodeHealth(app, path, node, failures)
+				}(node)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// 探测节点，连续失败达到阈值后在本进程中标记为不健康，继续探测，恢复后重新标记为健康
+// 不从注册中心注销节点，调用方自身的网络问题不应影响其他调用方，节点是否存在由租约决定
+func checkNodeHealth(app, path string, node *NodeInfo, failures int) {
+	cp := getClientPool(app)
+	if cp == nil {
+		return
+	}
+	r := cp.Get(fmt.Sprintf("http://%s%s", node.Addr, path))
+	statusCode := 0
+	if r.Response != nil {
+		statusCode = r.Response.StatusCode
+	}
+
+	if r.Error == nil && statusCode >= 200 && statusCode < 300 {
+		atomic.StoreInt32(&node.health.failures, 0)
+		if atomic.CompareAndSwapInt32(&node.health.unhealthy, 1, 0) {
+			log.Printf("DISCOVER	Healthy	%s	%s	%d	%d", app, node.Addr, node.Weight, statusCode)
+		}
+		return
+	}
+
+	failedTimes := atomic.AddInt32(&node.health.failures, 1)
+	log.Printf("DISCOVER	Check Failed	%s	%s	%d	%d	%d	%s", app, node.Addr, node.Weight, failedTimes, statusCode, r.Error)
+	if int(failedTimes) >= failures && atomic.CompareAndSwapInt32(&node.health.unhealthy, 0, 1) {
+		log.Printf("DISCOVER	Unhealthy	%s	%s	%d	%d	%d	%s", app, node.Addr, node.Weight, failedTimes, statusCode, r.Error)
+	}
+}
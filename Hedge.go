@@ -0,0 +1,166 @@
+package s
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 支持对冲请求的负载均衡算法，节点响应慢而向另一个节点发出对冲请求时通知
+type HedgeLoadBalancer interface {
+	LoadBalancer
+	Hedge(node, hedgeNode *NodeInfo)
+}
+
+// 计算对冲延迟使用的最近响应时间数量
+const hedgeSamples = 128
+
+// 计算百分位延迟至少需要的响应时间数量，不足时使用固定延迟
+const hedgeMinSamples = 16
+
+// 应用的对冲策略，hedgeDelay 为固定的延迟（毫秒），hedgePercentile 使用最近成功请求响应时间的百分位作为延迟（例如 95）
+type hedgePolicy struct {
+	delay      time.Duration
+	percentile float64
+
+	lock      sync.Mutex
+	latencies []int64
+	next      int
+}
+
+func makeHedgePolicy(hedgeDelay int, hedgePercentile float64) *hedgePolicy {
+	if hedgeDelay <= 0 && hedgePercentile <= 0 {
+		return nil
+	}
+	if hedgePercentile > 100 {
+		hedgePercentile = 100
+	}
+	return &hedgePolicy{delay: time.Duration(hedgeDelay) * time.Millisecond, percentile: hedgePercentile}
+}
+
+// 记录成功请求的响应时间（纳秒）
+func (policy *hedgePolicy) record(responseTimeing int64) {
+	if policy == nil || policy.percentile <= 0 {
+		return
+	}
+	policy.lock.Lock()
+	if len(policy.latencies) < hedgeSamples {
+		policy.latencies = append(policy.latencies, responseTimeing)
+	} else {
+		policy.latencies[policy.next] = responseTimeing
+		policy.next = (policy.next + 1) % hedgeSamples
+	}
+	policy.lock.Unlock()
+}
+
+// 发出对冲请求前等待的时间，0 表示不对冲
+func (policy *hedgePolicy) hedgeDelay() time.Duration {
+	if policy == nil {
+		return 0
+	}
+	if policy.percentile > 0 {
+		policy.lock.Lock()
+		latencies := make([]int64, len(policy.latencies))
+		copy(latencies, policy.latencies)
+		policy.lock.Unlock()
+		if len(latencies) >= hedgeMinSamples {
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			i := int(float64(len(latencies))*policy.percentile/100+0.5) - 1
+			if i < 0 {
+				i = 0
+			} else if i >= len(latencies) {
+				i = len(latencies) - 1
+			}
+			return time.Duration(latencies[i])
+		}
+	}
+	return policy.delay
+}
+
+// 开启对冲请求，节点超过 delay 没有响应时向另一个节点再发一个请求，替代 Calls 中配置的 hedgeDelay、hedgePercentile
+func (caller *Caller) WithHedge(delay time.Duration) *Caller {
+	newCaller := *caller
+	newCaller.hedge = delay
+	return &newCaller
+}
+
+// 本次调用的对冲延迟，只有可以重复发送的请求才会对冲
+func (caller *Caller) getHedgeDelay(hedge *hedgePolicy, retry *retryPolicy, method string, headers []string) time.Duration {
+	if !retry.idempotent(method, headers) {
+		return 0
+	}
+	if caller.hedge > 0 {
+		return caller.hedge
+	}
+	return hedge.hedgeDelay()
+}
+
+type hedgeResult struct {
+	node            *NodeInfo
+	r               *Result
+	usedTimes       uint64
+	responseTimeing int64
+}
+
+// 对冲请求，node 超过 delay 没有响应时向 nextNode 选出的节点再发一个请求，使用先成功的结果并取消另一个请求
+// 两个请求都失败时返回后失败的结果
+func doHedgedCall(ctx context.Context, app string, lb LoadBalancer, node *NodeInfo, delay time.Duration, nextNode func() *NodeInfo, method, path string, data interface{}, headers []string) (*NodeInfo, *Result, uint64, int64) {
+	results := make(chan *hedgeResult, 2)
+	cancels := map[*NodeInfo]context.CancelFunc{}
+	call := func(node *NodeInfo) {
+		nodeCtx, cancel := context.WithCancel(ctx)
+		cancels[node] = cancel
+		go func() {
+			r, usedTimes, responseTimeing := callNode(nodeCtx, app, node, method, path, data, headers)
+			results <- &hedgeResult{node: node, r: r, usedTimes: usedTimes, responseTimeing: responseTimeing}
+		}()
+	}
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	call(node)
+	pending := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case res := <-results:
+		return res.node, res.r, res.usedTimes, res.responseTimeing
+	case <-timer.C:
+	}
+
+	if hedgeNode := nextNode(); hedgeNode != nil {
+		atomic.AddUint64(&node.HedgedTimes, 1)
+		log.Printf("DISCOVER	Hedge	%s	%s	%s	%s	%d", app, path, node.Addr, hedgeNode.Addr, delay/time.Millisecond)
+		if hlb, ok := lb.(HedgeLoadBalancer); ok {
+			hlb.Hedge(node, hedgeNode)
+		}
+		call(hedgeNode)
+		pending++
+	}
+
+	var res *hedgeResult
+	for ; pending > 0; pending-- {
+		res = <-results
+		statusCode := 0
+		if res.r.Response != nil {
+			statusCode = res.r.Response.StatusCode
+		}
+		if res.r.Error == nil && statusCode != 502 && statusCode != 503 && statusCode != 504 {
+			break
+		}
+	}
+
+	// 没有使用的请求不计入节点的熔断
+	for otherNode := range cancels {
+		if otherNode != res.node {
+			otherNode.breaker.release()
+		}
+	}
+	return res.node, res.r, res.usedTimes, res.responseTimeing
+}
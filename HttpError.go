@@ -0,0 +1,50 @@
+package s
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// 服务返回的错误，Status 为输出的 HTTP 状态码，Code 为业务的错误码
+type HttpError struct {
+	Status  int
+	Code    int
+	Message string
+}
+
+// 错误内容的格式，Result.Err 会解析其中的 message
+type errorBody struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// 创建错误，code 为 0 时使用 status
+func NewHttpError(status, code int, message string) *HttpError {
+	if code == 0 {
+		code = status
+	}
+	return &HttpError{Status: status, Code: code, Message: message}
+}
+
+func (err *HttpError) Error() string {
+	return fmt.Sprintf("HTTP	%d	%d	%s", err.Status, err.Code, err.Message)
+}
+
+// 转换为状态码和错误内容，其他类型的错误输出 500，不输出错误的详细信息
+func makeErrorResult(err error) (int, *errorBody) {
+	if httpErr, ok := err.(*HttpError); ok && httpErr != nil {
+		status := httpErr.Status
+		if status < 100 || status > 999 {
+			status = http.StatusInternalServerError
+		}
+		code := httpErr.Code
+		if code == 0 {
+			code = status
+		}
+		return status, &errorBody{Code: code, Message: httpErr.Message}
+	}
+	return http.StatusInternalServerError, &errorBody{Code: http.StatusInternalServerError, Message: http.StatusText(http.StatusInternalServerError)}
+}
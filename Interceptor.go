@@ -0,0 +1,91 @@
+package s
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 客户端的请求，拦截器中可以修改
+type ClientRequest struct {
+	Context context.Context
+	App     string // 通过 Caller 调用时为应用名称
+	Method  string
+	Url     string
+	Data    interface{} // 请求数据，发送时编码为 JSON
+	Body    io.Reader   // 流式请求的请求内容
+	Stream  bool        // 是否流式请求（DoStream）
+	Headers []string
+}
+
+// 客户端拦截器，调用 next 继续请求并得到结果，可以在前后添加处理（签名、追踪、统计、日志等），不调用 next 时直接返回结果
+type ClientInterceptor func(request *ClientRequest, next func(*ClientRequest) *Result) *Result
+
+// 全局的客户端拦截器（[]ClientInterceptor），添加时复制后替换，请求中无需加锁
+var globalClientInterceptors atomic.Value
+var globalClientInterceptorsLock sync.Mutex
+var namedClientInterceptors = map[string]ClientInterceptor{}
+
+// 添加一个全局的客户端拦截器，对所有 ClientPool 的请求生效，按添加的顺序执行（先添加的在外层）
+func AddClientInterceptor(interceptor ClientInterceptor) {
+	globalClientInterceptorsLock.Lock()
+	defer globalClientInterceptorsLock.Unlock()
+	interceptors, _ := globalClientInterceptors.Load().([]ClientInterceptor)
+	newInterceptors := make([]ClientInterceptor, len(interceptors), len(interceptors)+1)
+	copy(newInterceptors, interceptors)
+	globalClientInterceptors.Store(append(newInterceptors, interceptor))
+}
+
+// 注册一个有名字的客户端拦截器，在 Calls 的 interceptors 中指定（逗号分隔）后对该应用的调用生效
+func RegisterClientInterceptor(name string, interceptor ClientInterceptor) {
+	namedClientInterceptors[name] = interceptor
+}
+
+// 为 ClientPool 添加拦截器，在全局拦截器之后执行
+func (cp *ClientPool) AddInterceptor(interceptor ClientInterceptor) {
+	cp.interceptors = append(cp.interceptors, interceptor)
+}
+
+// 为应用的 ClientPool 添加 Calls 中指定的拦截器
+func (cp *ClientPool) addNamedInterceptors(names string) {
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		interceptor := namedClientInterceptors[name]
+		if interceptor == nil {
+			log.Printf("CLIENT	Unknown Interceptor	%s	%s", cp.app, name)
+			continue
+		}
+		cp.AddInterceptor(interceptor)
+	}
+}
+
+// 依次执行全局拦截器、ClientPool 的拦截器，最后发起请求
+func (cp *ClientPool) intercept(request *ClientRequest, send func(*ClientRequest) *Result) *Result {
+	// 限制容量，拦截器 append 时会复制，不会修改调用方以及同时进行的对冲请求共用的数组
+	request.Headers = request.Headers[:len(request.Headers):len(request.Headers)]
+
+	globalInterceptors, _ := globalClientInterceptors.Load().([]ClientInterceptor)
+	if len(globalInterceptors) == 0 && len(cp.interceptors) == 0 {
+		return send(request)
+	}
+	interceptors := make([]ClientInterceptor, 0, len(globalInterceptors)+len(cp.interceptors))
+	interceptors = append(interceptors, globalInterceptors...)
+	interceptors = append(interceptors, cp.interceptors...)
+
+	var next func(i int) func(*ClientRequest) *Result
+	next = func(i int) func(*ClientRequest) *Result {
+		if i == len(interceptors) {
+			return send
+		}
+		return func(request *ClientRequest) *Result {
+			return interceptors[i](request, next(i+1))
+		}
+	}
+	return next(0)(request)
+}
@@ -1,39 +1,289 @@
 package s
 
-import "net/http"
+import (
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-// 设置一个负载均衡算法
+// 设置一个负载均衡算法，用于未在 Calls 中指定 LoadBalancer 的应用
 func SetLoadBalancer(lb LoadBalancer) {
 	settedLoadBalancer = lb
 }
 
+// 内置的负载均衡算法，可以在 Calls 中通过 LoadBalancer 为每个应用指定
+var loadBalancerMakers = map[string]func() LoadBalancer{
+	"roundrobin":      func() LoadBalancer { return &RoundRobinLoadBalancer{} },
+	"leastrequesting": func() LoadBalancer { return &LeastRequestingLoadBalancer{} },
+	"ewma":            func() LoadBalancer { return &EWMALoadBalancer{} },
+	"p2c":             func() LoadBalancer { return &P2CLoadBalancer{} },
+	"hash":            func() LoadBalancer { return &ConsistentHashLoadBalancer{} },
+}
+
+func makeLoadBalancer(name string) LoadBalancer {
+	if name == "" {
+		return nil
+	}
+	maker := loadBalancerMakers[strings.ToLower(name)]
+	if maker == nil {
+		log.Printf("DISCOVER	Unknown LoadBalancer	%s", name)
+		return nil
+	}
+	return maker()
+}
+
+// 负载均衡算法会在多个请求中并发调用，NodeInfo 的计数器需要使用 atomic 读取
 type LoadBalancer interface {
 
-	// 每个请求完成后提供信息
+	// 每个请求完成后提供信息，responseTimeing 为请求耗时（纳秒）
 	Response(node *NodeInfo, err error, response *http.Response, responseTimeing int64)
 
 	// 请求时根据节点的得分取最小值发起请求
 	Next(nodes []*NodeInfo, request *http.Request) *NodeInfo
 }
 
+// 支持按 Key 选择节点的负载均衡算法，调用时存在 Key 会使用 NextByKey 代替 Next
+type KeyLoadBalancer interface {
+	LoadBalancer
+
+	// 根据 Key 选择节点，相同的 Key 和节点列表需要返回相同的节点
+	NextByKey(nodes []*NodeInfo, key string) *NodeInfo
+}
+
+var defaultKeyLoadBalancer KeyLoadBalancer = &ConsistentHashLoadBalancer{}
+
 type DefaultLoadBalancer struct{}
 
 func (lba *DefaultLoadBalancer) Response(node *NodeInfo, err error, response *http.Response, responseTimeing int64) {
-	node.Data = float64(node.UsedTimes) / float64(node.Weight)
 }
 
 func (lba *DefaultLoadBalancer) Next(nodes []*NodeInfo, request *http.Request) *NodeInfo {
 	var minScore float64 = -1
 	var minNode *NodeInfo = nil
 	for _, node := range nodes {
-		if node.Data == nil {
-			node.Data = float64(node.UsedTimes) / float64(node.Weight)
+		score := float64(atomic.LoadUint64(&node.UsedTimes)) / float64(node.Weight)
+		if minScore == -1 || score < minScore {
+			minScore = score
+			minNode = node
+		}
+	}
+	return minNode
+}
+
+// 平滑加权轮询
+type RoundRobinLoadBalancer struct {
+	lock           sync.Mutex
+	currentWeights map[string]int
+}
+
+func (lba *RoundRobinLoadBalancer) Response(node *NodeInfo, err error, response *http.Response, responseTimeing int64) {
+}
+
+func (lba *RoundRobinLoadBalancer) Next(nodes []*NodeInfo, request *http.Request) *NodeInfo {
+	lba.lock.Lock()
+	defer lba.lock.Unlock()
+	if lba.currentWeights == nil {
+		lba.currentWeights = map[string]int{}
+	}
+
+	totalWeight := 0
+	var maxNode *NodeInfo = nil
+	for _, node := range nodes {
+		totalWeight += node.Weight
+		lba.currentWeights[node.Addr] += node.Weight
+		if maxNode == nil || lba.currentWeights[node.Addr] > lba.currentWeights[maxNode.Addr] {
+			maxNode = node
+		}
+	}
+	if maxNode != nil {
+		lba.currentWeights[maxNode.Addr] -= totalWeight
+	}
+
+	// 所有节点都已有记录，记录更多时说明有节点已经离开
+	if len(lba.currentWeights) > len(nodes) {
+		existsAddrs := make(map[string]bool, len(nodes))
+		for _, node := range nodes {
+			existsAddrs[node.Addr] = true
+		}
+		for addr := range lba.currentWeights {
+			if !existsAddrs[addr] {
+				delete(lba.currentWeights, addr)
+			}
+		}
+	}
+	return maxNode
+}
+
+// 按权重选择正在处理的请求最少的节点
+type LeastRequestingLoadBalancer struct{}
+
+func (lba *LeastRequestingLoadBalancer) Response(node *NodeInfo, err error, response *http.Response, responseTimeing int64) {
+}
+
+func (lba *LeastRequestingLoadBalancer) Next(nodes []*NodeInfo, request *http.Request) *NodeInfo {
+	var minNode *NodeInfo = nil
+	for _, node := range nodes {
+		if minNode == nil || compareRequesting(node, minNode) < 0 {
+			minNode = node
+		}
+	}
+	return minNode
+}
+
+// 按权重比较正在处理的请求数，相同时比较总请求数
+func compareRequesting(node1, node2 *NodeInfo) float64 {
+	score := float64(atomic.LoadInt64(&node1.Requesting))/float64(node1.Weight) - float64(atomic.LoadInt64(&node2.Requesting))/float64(node2.Weight)
+	if score == 0 {
+		score = float64(atomic.LoadUint64(&node1.UsedTimes))/float64(node1.Weight) - float64(atomic.LoadUint64(&node2.UsedTimes))/float64(node2.Weight)
+	}
+	return score
+}
+
+// 随机选择两个节点，使用正在处理的请求较少的一个
+type P2CLoadBalancer struct{}
+
+func (lba *P2CLoadBalancer) Response(node *NodeInfo, err error, response *http.Response, responseTimeing int64) {
+}
+
+func (lba *P2CLoadBalancer) Next(nodes []*NodeInfo, request *http.Request) *NodeInfo {
+	if len(nodes) < 2 {
+		if len(nodes) == 1 {
+			return nodes[0]
+		}
+		return nil
+	}
+	i := rand.Intn(len(nodes))
+	j := rand.Intn(len(nodes) - 1)
+	if j >= i {
+		j++
+	}
+	if compareRequesting(nodes[j], nodes[i]) < 0 {
+		return nodes[j]
+	}
+	return nodes[i]
+}
+
+// 按响应时间的指数加权移动平均值选择节点，同时考虑正在处理的请求数和权重
+// 失败的请求按 CallTimeout 计算耗时，没有数据的新节点优先尝试
+// 记录的耗时随时间衰减（DecayTime，默认10秒），变慢后不再被选择的节点过一段时间会重新获得请求
+type EWMALoadBalancer struct {
+	DecayTime time.Duration
+	lock      sync.Mutex
+	latencies map[string]*ewmaLatency
+	pruneTime time.Time
+}
+
+type ewmaLatency struct {
+	value    float64
+	time     time.Time // 最后一次更新的时间
+	seenTime time.Time // 最后一次出现在节点列表中的时间
+}
+
+const ewmaAlpha = 0.3
+
+// 超过这个时间没有出现在节点列表中的节点删除记录
+const ewmaExpireTime = time.Minute
+
+func (lba *EWMALoadBalancer) decayed(latency *ewmaLatency, now time.Time) float64 {
+	decayTime := lba.DecayTime
+	if decayTime <= 0 {
+		decayTime = 10 * time.Second
+	}
+	return latency.value * math.Exp(-float64(now.Sub(latency.time))/float64(decayTime))
+}
+
+func (lba *EWMALoadBalancer) Response(node *NodeInfo, err error, response *http.Response, responseTimeing int64) {
+	latency := float64(responseTimeing)
+	if err != nil || (response != nil && response.StatusCode >= 500) {
+		penalty := float64(config.CallTimeout) * 1e6
+		if penalty <= 0 {
+			penalty = 5e9
+		}
+		if latency < penalty {
+			latency = penalty
+		}
+	}
+
+	lba.lock.Lock()
+	defer lba.lock.Unlock()
+	if lba.latencies == nil {
+		lba.latencies = map[string]*ewmaLatency{}
+	}
+	now := time.Now()
+	if oldLatency := lba.latencies[node.Addr]; oldLatency != nil {
+		latency = ewmaAlpha*latency + (1-ewmaAlpha)*lba.decayed(oldLatency, now)
+	}
+	lba.latencies[node.Addr] = &ewmaLatency{value: latency, time: now, seenTime: now}
+}
+
+func (lba *EWMALoadBalancer) Next(nodes []*NodeInfo, request *http.Request) *NodeInfo {
+	lba.lock.Lock()
+	defer lba.lock.Unlock()
+
+	now := time.Now()
+	var minScore float64 = -1
+	var minNode *NodeInfo = nil
+	for _, node := range nodes {
+		var latency float64 = 0
+		if l := lba.latencies[node.Addr]; l != nil {
+			l.seenTime = now
+			latency = lba.decayed(l, now)
 		}
-		score := node.Data.(float64)
+		score := latency * float64(atomic.LoadInt64(&node.Requesting)+1) / float64(node.Weight)
 		if minScore == -1 || score < minScore {
 			minScore = score
 			minNode = node
 		}
 	}
+
+	// 定期删除已经离开的节点（节点列表可能因为重试等原因被临时过滤，所以按时间判断）
+	if now.Sub(lba.pruneTime) > ewmaExpireTime {
+		for addr, l := range lba.latencies {
+			if now.Sub(l.seenTime) > ewmaExpireTime {
+				delete(lba.latencies, addr)
+			}
+		}
+		lba.pruneTime = now
+	}
 	return minNode
 }
+
+// 一致性哈希（加权 Rendezvous Hashing），节点加入或离开时只有该节点上的 Key 会重新分配
+// 没有 Key 时和 DefaultLoadBalancer 相同
+type ConsistentHashLoadBalancer struct {
+	DefaultLoadBalancer
+}
+
+func (lba *ConsistentHashLoadBalancer) NextByKey(nodes []*NodeInfo, key string) *NodeInfo {
+	var maxScore float64 = -1
+	var maxNode *NodeInfo = nil
+	for _, node := range nodes {
+		score := -float64(node.Weight) / math.Log(hashToUnit(key, node.Addr))
+		if maxScore == -1 || score > maxScore {
+			maxScore = score
+			maxNode = node
+		}
+	}
+	return maxNode
+}
+
+// 将 Key 和节点地址哈希到 (0, 1) 区间
+func hashToUnit(key, addr string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return (float64(x>>11) + 0.5) / (1 << 53)
+}
@@ -0,0 +1,353 @@
+package s
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type clientMaker struct {
+	imports  map[string]string
+	types    map[reflect.Type]string
+	names    map[string]bool
+	typeDefs []string
+	methods  []string
+}
+
+var clientFuncNameMatcher = regexp.MustCompile("^func\\d+$")
+var clientWordMatcher = regexp.MustCompile("[A-Za-z0-9]+")
+
+// 根据已注册的服务生成调用客户端的代码，每个服务生成一个使用 Caller 调用的方法，参数和返回值使用服务的类型
+func MakeClient(app, packageName string) ([]byte, error) {
+	maker := &clientMaker{
+		imports: map[string]string{"github.com/ssgo/s": "s"},
+		types:   map[reflect.Type]string{},
+		names:   map[string]bool{"Client": true, "NewClient": true, "App": true},
+	}
+
+	services := webServices
+	paths := make([]string, 0, len(services))
+	for path := range services {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	methodNames := map[string]bool{}
+	for _, path := range paths {
+		methods := make([]string, 0)
+		for method := range services[path] {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		for _, method := range methods {
+			s := services[path][method]
+			name := makeClientMethodName(s, path)
+			for i := 2; methodNames[name]; i++ {
+				name = makeClientMethodName(s, path) + strconv.Itoa(i)
+			}
+			methodNames[name] = true
+			maker.makeMethod(name, path, s)
+		}
+	}
+
+	importPaths := make([]string, 0, len(maker.imports))
+	for importPath := range maker.imports {
+		importPaths = append(importPaths, importPath)
+	}
+	sort.Strings(importPaths)
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by github.com/ssgo/s/cmd/sclient. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\nimport (\n", packageName)
+	for _, importPath := range importPaths {
+		if maker.imports[importPath] == filepath.Base(importPath) {
+			fmt.Fprintf(&buf, "\t%q\n", importPath)
+		} else {
+			fmt.Fprintf(&buf, "\t%s %q\n", maker.imports[importPath], importPath)
+		}
+	}
+	buf.WriteString(")\n\n")
+	fmt.Fprintf(&buf, "// 服务的应用名称\nconst App = %q\n\n", app)
+	buf.WriteString("type Client struct {\n\tApp    string\n\tCaller *s.Caller\n}\n\n")
+	buf.WriteString("// 使用 Caller 调用服务，在服务方法中使用注入的 *s.Caller 可以传递请求的 Context 和 Header\n")
+	buf.WriteString("func NewClient(caller *s.Caller) *Client {\n\treturn &Client{App: App, Caller: caller}\n}\n\n")
+	for _, typeDef := range maker.typeDefs {
+		buf.WriteString(typeDef)
+		buf.WriteString("\n\n")
+	}
+	for _, method := range maker.methods {
+		buf.WriteString(method)
+		buf.WriteString("\n\n")
+	}
+
+	return format.Source(buf.Bytes())
+}
+
+// 只在使用 sclient 标签编译时设置（见 MakeClientCmd.go），正常编译的服务不会生成客户端代码
+var makeClientOnStart func()
+
+// 生成客户端代码写入文件后退出，S_CLIENT_APP 指定应用名称（默认为 app 配置），S_CLIENT_PACKAGE 指定包名（默认为目录名）
+func makeClientFile(clientFile string) {
+	if clientFile == "" {
+		log.Print("CLIENT	No Output File")
+		os.Exit(1)
+	}
+	app := os.Getenv("S_CLIENT_APP")
+	if app == "" {
+		app = config.App
+	}
+	if app == "" {
+		log.Print("CLIENT	No App")
+		os.Exit(1)
+	}
+	packageName := os.Getenv("S_CLIENT_PACKAGE")
+	if packageName == "" {
+		absFile, _ := filepath.Abs(clientFile)
+		packageName = filepath.Base(filepath.Dir(absFile))
+	}
+
+	code, err := MakeClient(app, packageName)
+	if err == nil {
+		os.MkdirAll(filepath.Dir(clientFile), 0755)
+		err = ioutil.WriteFile(clientFile, code, 0644)
+	}
+	if err != nil {
+		log.Print("CLIENT	", err)
+		os.Exit(1)
+	}
+	log.Printf("CLIENT	%s	%s	Generated", app, clientFile)
+	os.Exit(0)
+}
+
+// 方法名使用服务函数的名字，匿名函数使用路径
+func makeClientMethodName(s *webServiceType, path string) string {
+	name := ""
+	if fn := runtime.FuncForPC(s.funcValue.Pointer()); fn != nil {
+		name = strings.TrimSuffix(fn.Name(), "-fm")
+		name = name[strings.LastIndexByte(name, '.')+1:]
+		if clientFuncNameMatcher.MatchString(name) {
+			name = ""
+		}
+	}
+	if name == "" {
+		texts, pathArgs := parseRouteArgs(path)
+		for i, arg := range pathArgs {
+			texts[i] += "/" + arg.name
+		}
+		for _, word := range clientWordMatcher.FindAllString(strings.Join(texts, "/"), -1) {
+			name += strings.ToUpper(word[0:1]) + word[1:]
+		}
+		if name == "" {
+			name = "Index"
+		}
+	}
+	return strings.ToUpper(name[0:1]) + name[1:]
+}
+
+func (maker *clientMaker) makeMethod(name, path string, s *webServiceType) {
+	parms := make([]string, 0)
+	var inType reflect.Type
+	inName := ""
+	if s.inType != nil {
+		inType = s.inType
+		if inType.Name() == "" && inType.Kind() == reflect.Struct {
+			inName = maker.defineType(name+"In", inType, true)
+		} else {
+			inName = maker.typeString(inType)
+		}
+	}
+
+	// 路径参数优先使用输入参数中的同名字段，{name:*} 中的 / 不转义
+	pathExpr := make([]string, 0)
+	texts, pathArgs := parseRouteArgs(path)
+	for i, arg := range pathArgs {
+		if texts[i] != "" {
+			pathExpr = append(pathExpr, strconv.Quote(texts[i]))
+		}
+		argValue := ""
+		isString := false
+		if inType != nil && inType.Kind() == reflect.Struct {
+			if field, ok := inType.FieldByNameFunc(func(fieldName string) bool { return strings.EqualFold(fieldName, arg.name) }); ok && field.PkgPath == "" {
+				argValue = "in." + field.Name
+			}
+		} else if inType != nil && inType.Kind() == reflect.Map {
+			argValue = fmt.Sprintf("in[%q]", arg.name)
+		}
+		if argValue == "" {
+			argValue = fmt.Sprintf("pathArg%d", i+1)
+			switch arg.kind {
+			case "int":
+				parms = append(parms, argValue+" int64")
+			case "float":
+				parms = append(parms, argValue+" float64")
+			default:
+				parms = append(parms, argValue+" string")
+				isString = true
+			}
+		}
+		if !isString {
+			maker.imports["fmt"] = "fmt"
+			argValue = "fmt.Sprint(" + argValue + ")"
+		}
+		if arg.kind != "*" {
+			maker.imports["net/url"] = "url"
+			argValue = "url.PathEscape(" + argValue + ")"
+		}
+		pathExpr = append(pathExpr, argValue)
+	}
+	if texts[len(texts)-1] != "" || len(pathExpr) == 0 {
+		pathExpr = append(pathExpr, strconv.Quote(texts[len(texts)-1]))
+	}
+
+	data := "nil"
+	if inType != nil {
+		parms = append(parms, "in "+inName)
+		data = "in"
+	}
+	parms = append(parms, "headers ...string")
+
+	// 处理所有请求方法的服务使用 POST 调用
+	method := s.method
+	if method == "" {
+		method = "POST"
+	}
+	call := fmt.Sprintf("c.Caller.Do(%q, c.App, %s, %s, headers...)", method, strings.Join(pathExpr, "+"), data)
+	var code string
+	if s.funcType.NumOut() == 0 || s.errorIndex == 0 {
+		code = fmt.Sprintf("func (c *Client) %s(%s) error {\n\treturn %s.Err()\n}", name, strings.Join(parms, ", "), call)
+	} else {
+		outType := s.funcType.Out(0)
+		outName := ""
+		if outType.Name() == "" && outType.Kind() == reflect.Struct {
+			outName = maker.defineType(name+"Out", outType, true)
+		} else {
+			outName = maker.typeString(outType)
+		}
+		if outType.Kind() == reflect.String || (outType.Kind() == reflect.Slice && outType.Elem().Kind() == reflect.Uint8) {
+			getter := "r.String()"
+			if outType.Kind() != reflect.String {
+				getter = "r.Bytes()"
+			}
+			if outType.Name() != "string" && outType.Name() != "" {
+				getter = outName + "(" + getter + ")"
+			}
+			code = fmt.Sprintf("func (c *Client) %s(%s) (out %s, err error) {\n\tr := %s\n\tif err = r.Err(); err == nil {\n\t\tout = %s\n\t}\n\treturn\n}", name, strings.Join(parms, ", "), outName, call, getter)
+		} else {
+			code = fmt.Sprintf("func (c *Client) %s(%s) (out %s, err error) {\n\terr = %s.StrictTo(&out)\n\treturn\n}", name, strings.Join(parms, ", "), outName, call)
+		}
+	}
+	maker.methods = append(maker.methods, fmt.Sprintf("// %s %s\n%s", method, path, code))
+}
+
+// 生成类型的定义，名字重复时增加序号
+func (maker *clientMaker) defineType(name string, t reflect.Type, anonymous bool) string {
+	if !anonymous {
+		if typeName, ok := maker.types[t]; ok {
+			return typeName
+		}
+	}
+	typeName := name
+	for i := 2; maker.names[typeName]; i++ {
+		typeName = name + strconv.Itoa(i)
+	}
+	maker.names[typeName] = true
+	if !anonymous {
+		maker.types[t] = typeName
+	}
+	// 先占位，类型中引用的其他类型定义在后面
+	index := len(maker.typeDefs)
+	maker.typeDefs = append(maker.typeDefs, "")
+	maker.typeDefs[index] = fmt.Sprintf("type %s %s", typeName, maker.underlyingString(t))
+	return typeName
+}
+
+func (maker *clientMaker) typeString(t reflect.Type) string {
+	if t.Name() != "" {
+		if t.PkgPath() == "" {
+			return t.Name()
+		}
+		// main 包中的类型和其他包中未导出的类型无法导入，在客户端中重新定义
+		if t.PkgPath() == "main" || !ast.IsExported(t.Name()) {
+			return maker.defineType(t.Name(), t, false)
+		}
+		maker.imports[t.PkgPath()] = strings.SplitN(t.String(), ".", 2)[0]
+		return t.String()
+	}
+	return maker.underlyingString(t)
+}
+
+func (maker *clientMaker) underlyingString(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + maker.typeString(t.Elem())
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 && t.Elem().Name() == "uint8" {
+			return "[]byte"
+		}
+		return "[]" + maker.typeString(t.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), maker.typeString(t.Elem()))
+	case reflect.Map:
+		return fmt.Sprintf("map[%s]%s", maker.typeString(t.Key()), maker.typeString(t.Elem()))
+	case reflect.Interface:
+		return "interface{}"
+	case reflect.Struct:
+		return "struct {\n" + strings.Join(maker.structFields(t, map[string]bool{}), "") + "}"
+	default:
+		return t.Kind().String()
+	}
+}
+
+// 生成结构体的字段，未导出的匿名字段无法引用，将其中导出的字段提升到外层（与 JSON 序列化的结果一致）
+// outerNames 为外层已有的字段，同名时外层的字段优先
+func (maker *clientMaker) structFields(t reflect.Type, outerNames map[string]bool) []string {
+	names := make(map[string]bool)
+	for name := range outerNames {
+		names[name] = true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		names[t.Field(i).Name] = true
+	}
+
+	fields := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if outerNames[field.Name] {
+			continue
+		}
+		if field.PkgPath != "" {
+			// 未导出的字段不会被序列化
+			if !field.Anonymous {
+				continue
+			}
+			embedType := field.Type
+			if embedType.Kind() == reflect.Ptr {
+				embedType = embedType.Elem()
+			}
+			if embedType.Kind() == reflect.Struct {
+				fields = append(fields, maker.structFields(embedType, names)...)
+			}
+			continue
+		}
+		fieldCode := maker.typeString(field.Type)
+		if !field.Anonymous {
+			fieldCode = field.Name + " " + fieldCode
+		}
+		if field.Tag != "" {
+			fieldCode += " `" + string(field.Tag) + "`"
+		}
+		fields = append(fields, "\t"+fieldCode+"\n")
+	}
+	return fields
+}
@@ -0,0 +1,13 @@
+//go:build sclient
+// +build sclient
+
+package s
+
+import "os"
+
+// sclient 命令使用 sclient 标签编译服务，启动时生成客户端代码写入 S_CLIENT_FILE 后退出
+func init() {
+	makeClientOnStart = func() {
+		makeClientFile(os.Getenv("S_CLIENT_FILE"))
+	}
+}
@@ -0,0 +1,88 @@
+package s
+
+import "sync"
+
+// 进程内的注册中心，同一进程中的服务可以相互发现，适合测试
+type MemoryRegistry struct {
+	lock     sync.Mutex
+	nodes    map[string]map[string]*RegistryNode
+	watchers []*memoryWatcher
+}
+
+type memoryWatcher struct {
+	apps     map[string]bool
+	onChange func(app, addr string, node *RegistryNode)
+}
+
+var defaultMemoryRegistry = NewMemoryRegistry()
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{nodes: map[string]map[string]*RegistryNode{}}
+}
+
+func (mr *MemoryRegistry) Register(app, addr string, node *RegistryNode) bool {
+	mr.lock.Lock()
+	if mr.nodes[app] == nil {
+		mr.nodes[app] = map[string]*RegistryNode{}
+	}
+	mr.nodes[app][addr] = node
+	mr.lock.Unlock()
+	mr.notify(app, addr, node)
+	return true
+}
+
+func (mr *MemoryRegistry) Unregister(app, addr string) bool {
+	mr.lock.Lock()
+	_, exists := mr.nodes[app][addr]
+	delete(mr.nodes[app], addr)
+	mr.lock.Unlock()
+	if exists {
+		mr.notify(app, addr, &RegistryNode{})
+	}
+	return exists
+}
+
+func (mr *MemoryRegistry) Nodes(app string) map[string]*RegistryNode {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	return copyNodes(mr.nodes[app])
+}
+
+func (mr *MemoryRegistry) Watch(apps []string, onReset func(app string, nodes map[string]*RegistryNode), onChange func(app, addr string, node *RegistryNode)) func() {
+	watcher := &memoryWatcher{apps: map[string]bool{}, onChange: onChange}
+	for _, app := range apps {
+		watcher.apps[app] = true
+	}
+	mr.lock.Lock()
+	mr.watchers = append(mr.watchers, watcher)
+	mr.lock.Unlock()
+
+	for _, app := range apps {
+		onReset(app, mr.Nodes(app))
+	}
+	return func() { mr.unwatch(watcher) }
+}
+
+// 只移除指定的监听，通知时使用的是移除前的列表，所以创建新的列表
+func (mr *MemoryRegistry) unwatch(watcher *memoryWatcher) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	watchers := make([]*memoryWatcher, 0, len(mr.watchers))
+	for _, w := range mr.watchers {
+		if w != watcher {
+			watchers = append(watchers, w)
+		}
+	}
+	mr.watchers = watchers
+}
+
+func (mr *MemoryRegistry) notify(app, addr string, node *RegistryNode) {
+	mr.lock.Lock()
+	watchers := mr.watchers
+	mr.lock.Unlock()
+	for _, watcher := range watchers {
+		if watcher.apps[app] {
+			watcher.onChange(app, addr, node)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package s
+
+import (
+	"log"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// 节点元数据的匹配条件，格式与 URL 参数相同，例如 version=2.*&zone=$zone
+// 值支持通配符（同 path.Match），$name 表示当前服务自身的元数据 name，同一个 key 有多个值时满足任意一个即可
+// tags 为逗号分隔的多个标签，任意一个标签匹配即可
+type metaConditions map[string][]string
+
+// 解析匹配条件，没有条件时返回 nil
+func parseMetaConditions(conditions string) metaConditions {
+	if conditions == "" {
+		return nil
+	}
+	values, err := url.ParseQuery(conditions)
+	if err != nil {
+		log.Printf("DISCOVER	Bad Conditions	%s	%s", conditions, err)
+		return nil
+	}
+	for key, patterns := range values {
+		for i, pattern := range patterns {
+			if strings.HasPrefix(pattern, "$") {
+				patterns[i] = config.Meta[pattern[1:]]
+			}
+		}
+		values[key] = patterns
+	}
+	return metaConditions(values)
+}
+
+// 节点元数据是否满足全部条件，没有条件时总是满足
+func (conditions metaConditions) match(meta map[string]string) bool {
+	for key, patterns := range conditions {
+		value, exists := meta[key]
+		if !exists {
+			return false
+		}
+		values := []string{value}
+		if key == "tags" {
+			values = strings.Split(value, ",")
+		}
+		if !matchAnyPattern(patterns, values) {
+			return false
+		}
+	}
+	return true
+}
+
+// 优先选择是否满足条件与 matched 相同的节点，没有这样的节点时返回全部节点
+func (conditions metaConditions) prefer(nodes []*NodeInfo, matched bool) []*NodeInfo {
+	preferredNodes := make([]*NodeInfo, 0, len(nodes))
+	for _, node := range nodes {
+		if conditions.match(node.Meta) == matched {
+			preferredNodes = append(preferredNodes, node)
+		}
+	}
+	if len(preferredNodes) == 0 {
+		return nodes
+	}
+	return preferredNodes
+}
+
+func matchAnyPattern(patterns, values []string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if matched, _ := path.Match(pattern, strings.TrimSpace(value)); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package s
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+type NodeInfo struct {
+	// 计数器使用 atomic 读写，放在最前面保证 64 位对齐
+	UsedTimes   uint64
+	HedgedTimes uint64 // 响应慢而发出对冲请求的次数
+	Requesting  int64
+	FailedTimes uint8 // 连续失败的次数，在熔断器的锁中修改
+	Addr        string
+	Weight      int
+	Meta        map[string]string // 节点注册时的元数据，只读
+	Data        interface{}
+	breaker     *nodeBreaker
+	health      *nodeHealth
+}
+
+// 各应用的节点表（app → addr → *NodeInfo），修改时复制整表后替换，请求中无需加锁即可读取到一致的快照
+var appNodes atomic.Value
+var appNodesLock sync.Mutex
+
+// 各应用的 ClientPool（app → *ClientPool），同样在修改时复制
+var appClientPools atomic.Value
+var appClientPoolsLock sync.Mutex
+
+// 各应用在 Calls 中指定的负载均衡算法（app → LoadBalancer）
+var appLoadBalancers atomic.Value
+var appLoadBalancersLock sync.Mutex
+
+// 各应用的重试策略（app → *retryPolicy），重试预算在同一应用的所有调用中共享
+var appRetryPolicies atomic.Value
+var appRetryPoliciesLock sync.Mutex
+
+// 各应用的对冲策略（app → *hedgePolicy），记录最近的响应时间
+var appHedgePolicies atomic.Value
+var appHedgePoliciesLock sync.Mutex
+
+// 获取应用的节点快照，不可修改，应用不存在时返回 nil
+func getAppNodes(app string) map[string]*NodeInfo {
+	allNodes, _ := appNodes.Load().(map[string]map[string]*NodeInfo)
+	return allNodes[app]
+}
+
+// 复制应用的节点表进行修改，完成后替换
+func updateAppNodes(app string, updater func(nodes map[string]*NodeInfo)) {
+	appNodesLock.Lock()
+	defer appNodesLock.Unlock()
+
+	allNodes, _ := appNodes.Load().(map[string]map[string]*NodeInfo)
+	newAllNodes := make(map[string]map[string]*NodeInfo, len(allNodes)+1)
+	for a, nodes := range allNodes {
+		newAllNodes[a] = nodes
+	}
+	newNodes := make(map[string]*NodeInfo, len(allNodes[app])+1)
+	for addr, node := range allNodes[app] {
+		newNodes[addr] = node
+	}
+	updater(newNodes)
+	newAllNodes[app] = newNodes
+	appNodes.Store(newAllNodes)
+}
+
+func getClientPool(app string) *ClientPool {
+	pools, _ := appClientPools.Load().(map[string]*ClientPool)
+	return pools[app]
+}
+
+func setClientPool(app string, cp *ClientPool) {
+	appClientPoolsLock.Lock()
+	defer appClientPoolsLock.Unlock()
+
+	pools, _ := appClientPools.Load().(map[string]*ClientPool)
+	newPools := make(map[string]*ClientPool, len(pools)+1)
+	for a, p := range pools {
+		newPools[a] = p
+	}
+	newPools[app] = cp
+	appClientPools.Store(newPools)
+}
+
+// 获取应用使用的负载均衡算法，未指定时使用 SetLoadBalancer 设置的算法
+func getLoadBalancer(app string) LoadBalancer {
+	lbs, _ := appLoadBalancers.Load().(map[string]LoadBalancer)
+	if lb := lbs[app]; lb != nil {
+		return lb
+	}
+	return settedLoadBalancer
+}
+
+func setLoadBalancer(app string, lb LoadBalancer) {
+	appLoadBalancersLock.Lock()
+	defer appLoadBalancersLock.Unlock()
+
+	lbs, _ := appLoadBalancers.Load().(map[string]LoadBalancer)
+	newLbs := make(map[string]LoadBalancer, len(lbs)+1)
+	for a, l := range lbs {
+		newLbs[a] = l
+	}
+	if lb == nil {
+		delete(newLbs, app)
+	} else {
+		newLbs[app] = lb
+	}
+	appLoadBalancers.Store(newLbs)
+}
+
+// 获取应用的重试策略，未配置时使用默认策略
+func getRetryPolicy(app string) *retryPolicy {
+	policies, _ := appRetryPolicies.Load().(map[string]*retryPolicy)
+	if policy := policies[app]; policy != nil {
+		return policy
+	}
+	return defaultRetryPolicy
+}
+
+func setRetryPolicy(app string, policy *retryPolicy) {
+	appRetryPoliciesLock.Lock()
+	defer appRetryPoliciesLock.Unlock()
+
+	policies, _ := appRetryPolicies.Load().(map[string]*retryPolicy)
+	newPolicies := make(map[string]*retryPolicy, len(policies)+1)
+	for a, p := range policies {
+		newPolicies[a] = p
+	}
+	newPolicies[app] = policy
+	appRetryPolicies.Store(newPolicies)
+}
+
+// 获取应用的对冲策略，未配置时返回 nil
+func getHedgePolicy(app string) *hedgePolicy {
+	policies, _ := appHedgePolicies.Load().(map[string]*hedgePolicy)
+	return policies[app]
+}
+
+func setHedgePolicy(app string, policy *hedgePolicy) {
+	appHedgePoliciesLock.Lock()
+	defer appHedgePoliciesLock.Unlock()
+
+	policies, _ := appHedgePolicies.Load().(map[string]*hedgePolicy)
+	newPolicies := make(map[string]*hedgePolicy, len(policies)+1)
+	for a, p := range policies {
+		newPolicies[a] = p
+	}
+	if policy == nil {
+		delete(newPolicies, app)
+	} else {
+		newPolicies[app] = policy
+	}
+	appHedgePolicies.Store(newPolicies)
+}
+
+// 第一次或断线后重新获取全量节点
+func resetNodes(app string, nodes map[string]*RegistryNode) {
+	updateAppNodes(app, func(appNodes map[string]*NodeInfo) {
+		for _, node := range appNodes {
+			if nodes[node.Addr] == nil || nodes[node.Addr].Weight == 0 {
+				log.Printf("DISCOVER	Remove When Reset	%s	%s	%d", app, node.Addr, 0)
+				pushNode(appNodes, node.Addr, 0, nil)
+			}
+		}
+		for addr, node := range nodes {
+			log.Printf("DISCOVER	Reset	%s	%s	%d", app, addr, node.Weight)
+			pushNode(appNodes, addr, node.Weight, node.Meta)
+		}
+	})
+}
+
+func receiveNode(app, addr string, node *RegistryNode) {
+	log.Printf("DISCOVER	Received	%s	%s	%d", app, addr, node.Weight)
+	updateAppNodes(app, func(appNodes map[string]*NodeInfo) {
+		pushNode(appNodes, addr, node.Weight, node.Meta)
+	})
+}
+
+func pushNode(appNodes map[string]*NodeInfo, addr string, weight int, meta map[string]string) {
+	oldNode := appNodes[addr]
+	if weight == 0 {
+		// 删除节点
+		delete(appNodes, addr)
+	} else if oldNode == nil {
+		// 新节点，以现有节点的平均得分作为初始值，避免新节点被集中访问
+		var totalScore float64 = 0
+		for _, node := range appNodes {
+			totalScore += float64(atomic.LoadUint64(&node.UsedTimes)) / float64(node.Weight)
+		}
+		var usedTimes uint64 = 0
+		if len(appNodes) > 0 {
+			usedTimes = uint64(totalScore / float64(len(appNodes)) * float64(weight))
+		}
+		appNodes[addr] = &NodeInfo{Addr: addr, Weight: weight, Meta: meta, UsedTimes: usedTimes, breaker: &nodeBreaker{}, health: &nodeHealth{}}
+	} else if oldNode.Weight != weight || !sameMeta(oldNode.Meta, meta) {
+		// 修改权重或元数据，替换为新的节点对象，保持得分不变
+		usedTimes := float64(atomic.LoadUint64(&oldNode.UsedTimes)) / float64(oldNode.Weight) * float64(weight)
+		appNodes[addr] = &NodeInfo{Addr: addr, Weight: weight, Meta: meta, UsedTimes: uint64(usedTimes), FailedTimes: oldNode.getFailedTimes(), breaker: oldNode.breaker, health: oldNode.health}
+	}
+}
+
+func sameMeta(meta1, meta2 map[string]string) bool {
+	if len(meta1) != len(meta2) {
+		return false
+	}
+	for k, v := range meta1 {
+		if v2, ok := meta2[k]; !ok || v2 != v {
+			return false
+		}
+	}
+	return true
+}
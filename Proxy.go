@@ -3,47 +3,45 @@ package s
 import (
 	"fmt"
 	"log"
-	"regexp"
 	"strings"
 )
 
-var proxies = make(map[string]*proxyInfo, 0)
-var regexProxies = make(map[string]*proxyInfo, 0)
+var proxyRoutes = newRouteTree()
 
 // 代理
 func Proxy(authLevel uint, path string, toApp, toPath string) {
-	p := &proxyInfo{authLevel: authLevel, toApp: toApp, toPath: toPath}
+	addProxy(nil, authLevel, path, toApp, toPath)
+}
+
+func addProxy(group *Group, authLevel uint, path string, toApp, toPath string) {
+	p := &proxyInfo{authLevel: authLevel, group: group, toApp: toApp, toPath: toPath}
+	var node *routeNode
+	var err error
 	if strings.Contains(path, "(") {
-		matcher, err := regexp.Compile("^" + path + "$")
-		if err != nil {
-			log.Print("Proxy	Compile	", err)
-		} else {
-			p.matcher = matcher
-			regexProxies[path] = p
-		}
+		node, err = proxyRoutes.addRegex(path)
+	} else {
+		node, _, err = proxyRoutes.add(path)
 	}
-	if p.matcher == nil {
-		proxies[path] = p
+	if err != nil {
+		log.Print("Proxy	Compile	", err)
+		return
 	}
+	node.value = p
 }
 
 // 查找 Proxy
-func findProxy(requestPath string) (*string, *string) {
-	pi := proxies[requestPath]
-	if pi != nil {
-		return &pi.toApp, &pi.toPath
+func findProxy(requestPath string) (*proxyInfo, *string) {
+	node, values := proxyRoutes.find(requestPath)
+	if node == nil {
+		return nil, nil
+	}
+	pi := node.value.(*proxyInfo)
+	if len(values) == 0 {
+		return pi, &pi.toPath
 	}
-	if len(regexProxies) > 0 {
-		for _, pi := range regexProxies {
-			finds := pi.matcher.FindAllStringSubmatch(requestPath, 20)
-			if len(finds) > 0 {
-				toPath := pi.toPath
-				for i, partValue := range finds[0] {
-					toPath = strings.Replace(toPath, fmt.Sprintf("$%d", i), partValue, 10)
-				}
-				return &pi.toApp, &toPath
-			}
-		}
+	toPath := strings.Replace(pi.toPath, "$0", requestPath, 10)
+	for i, partValue := range values {
+		toPath = strings.Replace(toPath, fmt.Sprintf("$%d", i+1), partValue, 10)
 	}
-	return nil, nil
+	return pi, &toPath
 }
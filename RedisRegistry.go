@@ -0,0 +1,342 @@
+package s
+
+import (
+	"encoding/json"
+	"fmt"
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/ssgo/redis"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 基于 Redis 的注册中心
+// 节点记录在 <prefix><app> 中（addr → weight），租约记录在 <prefix>LEASE_<app> 中（addr → 过期时间），变化通过 <prefix>CH_<app> 发布
+// 元数据单独记录在 <prefix>META_<app> 中（addr → JSON），不影响旧版本读取节点和通知
+type RedisRegistry struct {
+	redis  *redis.Redis
+	prefix string
+	ttl    int
+
+	lock          sync.Mutex
+	registrations map[string]map[string]*RegistryNode
+	watchers      map[*redisWatcher]bool
+	keeperRunning bool
+}
+
+// 一次监听，每个监听使用单独的订阅连接
+type redisWatcher struct {
+	apps     []string
+	running  bool
+	conn     *redigo.PubSubConn
+	stopChan chan bool
+}
+
+func NewRedisRegistry(name, prefix string, ttl int) (*RedisRegistry, error) {
+	rd := redis.GetRedis(name)
+	if rd.Error != nil {
+		return nil, rd.Error
+	}
+	if ttl <= 0 {
+		ttl = 15000
+	}
+	return &RedisRegistry{redis: rd, prefix: prefix, ttl: ttl, registrations: map[string]map[string]*RegistryNode{}, watchers: map[*redisWatcher]bool{}}, nil
+}
+
+func (rr *RedisRegistry) Register(app, addr string, node *RegistryNode) bool {
+	// 先写入元数据，收到通知时可以读取到
+	rr.setMeta(app, addr, node.Meta)
+	// 地址已经存在时（例如节点重启时旧的租约还未过期）HSET 返回 0，同样需要续约和记录注册信息
+	if rr.redis.Do("HSET", rr.prefix+app, addr, node.Weight).Error != nil {
+		return false
+	}
+	rr.refreshLease(app, addr)
+	rr.redis.Do("PUBLISH", rr.prefix+"CH_"+app, fmt.Sprintf("%s %d", addr, node.Weight))
+
+	rr.lock.Lock()
+	if rr.registrations[app] == nil {
+		rr.registrations[app] = map[string]*RegistryNode{}
+	}
+	rr.registrations[app][addr] = node
+	rr.lock.Unlock()
+	rr.startKeeper()
+	return true
+}
+
+func (rr *RedisRegistry) Unregister(app, addr string) bool {
+	rr.lock.Lock()
+	delete(rr.registrations[app], addr)
+	rr.lock.Unlock()
+
+	rr.redis.Do("ZREM", rr.prefix+"LEASE_"+app, addr)
+	rr.redis.HDEL(rr.prefix+"META_"+app, addr)
+	if rr.redis.HDEL(rr.prefix+app, addr) > 0 {
+		rr.redis.Do("PUBLISH", rr.prefix+"CH_"+app, fmt.Sprintf("%s %d", addr, 0))
+		return true
+	}
+	return false
+}
+
+func (rr *RedisRegistry) Nodes(app string) map[string]*RegistryNode {
+	metas := rr.redis.Do("HGETALL", rr.prefix+"META_"+app).ResultMap()
+	nodes := map[string]*RegistryNode{}
+	for addr, weightResult := range rr.redis.Do("HGETALL", rr.prefix+app).ResultMap() {
+		node := &RegistryNode{Weight: weightResult.Int()}
+		if metaResult := metas[addr]; metaResult != nil {
+			node.Meta = decodeMeta(metaResult.String())
+		}
+		nodes[addr] = node
+	}
+	return nodes
+}
+
+// 写入节点的元数据，没有元数据时删除
+func (rr *RedisRegistry) setMeta(app, addr string, meta map[string]string) {
+	if len(meta) == 0 {
+		rr.redis.HDEL(rr.prefix+"META_"+app, addr)
+		return
+	}
+	metaBytes, _ := json.Marshal(meta)
+	rr.redis.Do("HSET", rr.prefix+"META_"+app, addr, string(metaBytes))
+}
+
+func decodeMeta(metaJson string) map[string]string {
+	if metaJson == "" {
+		return nil
+	}
+	meta := map[string]string{}
+	if err := json.Unmarshal([]byte(metaJson), &meta); err != nil {
+		log.Printf("DISCOVER	Bad Meta	%s	%s", metaJson, err)
+		return nil
+	}
+	return meta
+}
+
+func (rr *RedisRegistry) Watch(apps []string, onReset func(app string, nodes map[string]*RegistryNode), onChange func(app, addr string, node *RegistryNode)) func() {
+	watcher := &redisWatcher{apps: apps, running: true, stopChan: make(chan bool)}
+	rr.lock.Lock()
+	rr.watchers[watcher] = true
+	rr.lock.Unlock()
+
+	// 先清除已过期的节点，再开始同步
+	rr.removeExpiredNodes()
+	rr.startKeeper()
+
+	initedChan := make(chan bool)
+	go rr.sync(watcher, onReset, onChange, initedChan)
+	<-initedChan
+	return func() { rr.unwatch(watcher) }
+}
+
+func (rr *RedisRegistry) unwatch(watcher *redisWatcher) {
+	rr.lock.Lock()
+	if !watcher.running {
+		rr.lock.Unlock()
+		return
+	}
+	watcher.running = false
+	delete(rr.watchers, watcher)
+	if watcher.conn != nil {
+		watcher.conn.Close()
+	}
+	rr.lock.Unlock()
+	<-watcher.stopChan
+}
+
+func (rr *RedisRegistry) isWatching(watcher *redisWatcher) bool {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	return watcher.running
+}
+
+func (rr *RedisRegistry) sync(watcher *redisWatcher, onReset func(app string, nodes map[string]*RegistryNode), onChange func(app, addr string, node *RegistryNode), initedChan chan bool) {
+	apps := watcher.apps
+	subscribeKeys := make([]interface{}, len(apps))
+	for i, app := range apps {
+		subscribeKeys[i] = rr.prefix + "CH_" + app
+	}
+
+	inited := false
+	for {
+		syncConn := &redigo.PubSubConn{Conn: rr.redis.GetConnection()}
+		rr.lock.Lock()
+		watcher.conn = syncConn
+		rr.lock.Unlock()
+		err := syncConn.Subscribe(subscribeKeys...)
+		if err != nil {
+			log.Print("REDIS SUBSCRIBE	", err)
+			syncConn.Close()
+
+			// 首次订阅失败时也提供当前的节点，订阅成功后再重新同步
+			if !inited {
+				for _, app := range apps {
+					onReset(app, rr.Nodes(app))
+				}
+				inited = true
+				initedChan <- true
+			}
+			time.Sleep(time.Second * 1)
+			if !rr.isWatching(watcher) {
+				break
+			}
+			continue
+		}
+
+		// 第一次或断线后重新获取（订阅开始后再获取全量确保信息完整）
+		for _, app := range apps {
+			onReset(app, rr.Nodes(app))
+		}
+		if !inited {
+			inited = true
+			initedChan <- true
+		}
+		if !rr.isWatching(watcher) {
+			break
+		}
+
+		// 开始接收订阅数据
+		for {
+			isErr := false
+			switch v := syncConn.Receive().(type) {
+			case redigo.Message:
+				a := strings.Split(string(v.Data), " ")
+				addr := a[0]
+				weight := 0
+				if len(a) == 2 {
+					weight, _ = strconv.Atoi(a[1])
+				}
+				app := strings.Replace(v.Channel, rr.prefix+"CH_", "", 1)
+				node := &RegistryNode{Weight: weight}
+				if weight > 0 {
+					node.Meta = decodeMeta(rr.redis.Do("HGET", rr.prefix+"META_"+app, addr).String())
+				}
+				onChange(app, addr, node)
+			case redigo.Subscription:
+			case error:
+				if !strings.Contains(v.Error(), "closed") {
+					log.Printf("REDIS RECEIVE ERROR	%s", v)
+				}
+				isErr = true
+			}
+			if isErr {
+				break
+			}
+		}
+		if !rr.isWatching(watcher) {
+			break
+		}
+		time.Sleep(time.Second * 1)
+		if !rr.isWatching(watcher) {
+			break
+		}
+	}
+
+	rr.lock.Lock()
+	if watcher.conn != nil {
+		watcher.conn.Close()
+		watcher.conn = nil
+	}
+	rr.lock.Unlock()
+	watcher.stopChan <- true
+}
+
+// 租约的过期时间使用 Redis 的时间（毫秒），避免各节点之间的时钟偏差使正常的节点过期
+const refreshLeaseScript = `redis.replicate_commands()
+local t = redis.call('TIME')
+redis.call('ZADD', KEYS[1], t[1] * 1000 + math.floor(t[2] / 1000) + tonumber(ARGV[2]), ARGV[1])
+return 1`
+
+// 在一个脚本中查找并删除过期的节点，返回被删除的节点，期间续约的节点不会被误删除
+const removeExpiredScript = `redis.replicate_commands()
+local t = redis.call('TIME')
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+local removed = {}
+for _, addr in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now)) do
+	redis.call('ZREM', KEYS[1], addr)
+	redis.call('HDEL', KEYS[2], addr)
+	if redis.call('HDEL', KEYS[3], addr) > 0 then
+		table.insert(removed, addr)
+	end
+end
+return removed`
+
+// 刷新节点的租约，值为过期时间（毫秒）
+func (rr *RedisRegistry) refreshLease(app, addr string) {
+	rr.redis.Do("EVAL", refreshLeaseScript, 1, rr.prefix+"LEASE_"+app, addr, rr.ttl)
+}
+
+// 定时发送心跳（租约时间的1/3），并清除租约过期的节点，没有注册和监听时结束
+func (rr *RedisRegistry) startKeeper() {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	if rr.keeperRunning {
+		return
+	}
+	rr.keeperRunning = true
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(rr.ttl/3) * time.Millisecond)
+		defer ticker.Stop()
+		for range ticker.C {
+			rr.lock.Lock()
+			if len(rr.registrations) == 0 && len(rr.watchers) == 0 {
+				rr.keeperRunning = false
+				rr.lock.Unlock()
+				return
+			}
+			rr.lock.Unlock()
+
+			rr.heartbeat()
+			rr.removeExpiredNodes()
+		}
+	}()
+}
+
+// 心跳，续约并在节点被误删除时重新注册
+func (rr *RedisRegistry) heartbeat() {
+	rr.lock.Lock()
+	registrations := map[string]map[string]*RegistryNode{}
+	for app, nodes := range rr.registrations {
+		if len(nodes) == 0 {
+			delete(rr.registrations, app)
+			continue
+		}
+		registrations[app] = copyNodes(nodes)
+	}
+	rr.lock.Unlock()
+
+	for app, nodes := range registrations {
+		for addr, node := range nodes {
+			rr.refreshLease(app, addr)
+			if rr.redis.Do("HSETNX", rr.prefix+app, addr, node.Weight).Int() == 1 {
+				log.Printf("DISCOVER	Reregistered	%s	%s	%d", app, addr, node.Weight)
+				rr.setMeta(app, addr, node.Meta)
+				rr.redis.Do("PUBLISH", rr.prefix+"CH_"+app, fmt.Sprintf("%s %d", addr, node.Weight))
+			}
+		}
+	}
+}
+
+// 清除租约过期的节点（注册的和监听的应用），多个节点同时清除时只有成功删除的节点发布通知
+func (rr *RedisRegistry) removeExpiredNodes() {
+	apps := map[string]bool{}
+	rr.lock.Lock()
+	for app := range rr.registrations {
+		apps[app] = true
+	}
+	for watcher := range rr.watchers {
+		for _, app := range watcher.apps {
+			apps[app] = true
+		}
+	}
+	rr.lock.Unlock()
+
+	for app := range apps {
+		for _, addr := range rr.redis.Do("EVAL", removeExpiredScript, 3, rr.prefix+"LEASE_"+app, rr.prefix+"META_"+app, rr.prefix+app).Strings() {
+			log.Printf("DISCOVER	Expired	%s	%s	%d", app, addr, 0)
+			rr.redis.Do("PUBLISH", rr.prefix+"CH_"+app, fmt.Sprintf("%s %d", addr, 0))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package s
+
+import "log"
+
+// 注册中心中的节点信息，Meta 为节点的元数据（例如 version、zone、tags）
+type RegistryNode struct {
+	Weight int
+	Meta   map[string]string
+}
+
+// 服务注册中心
+type Registry interface {
+
+	// 注册节点，注销前需要由注册中心自行维持节点的有效性（例如租约）
+	Register(app, addr string, node *RegistryNode) bool
+
+	// 注销节点
+	Unregister(app, addr string) bool
+
+	// 获取应用的全部节点（addr → node）
+	Nodes(app string) map[string]*RegistryNode
+
+	// 开始监听应用节点的变化，完成首次同步后返回
+	// 每次（重新）开始监听时调用 onReset 提供全量节点，节点变化时调用 onChange（Weight 为 0 表示删除）
+	// 返回的 unwatch 只停止本次监听，等待监听结束后返回
+	Watch(apps []string, onReset func(app string, nodes map[string]*RegistryNode), onChange func(app, addr string, node *RegistryNode)) (unwatch func())
+}
+
+var settedRegistry Registry
+
+// 设置一个注册中心，未设置时根据配置 Registry 创建
+func SetRegistry(registry Registry) {
+	settedRegistry = registry
+}
+
+// 根据配置创建注册中心，memory 为进程内注册中心，static 使用配置 StaticNodes 中的节点，其他为 Redis 配置名称
+func makeRegistry() Registry {
+	if settedRegistry != nil {
+		return settedRegistry
+	}
+
+	switch {
+	case config.Registry == "memory":
+		return defaultMemoryRegistry
+	case config.Registry == "static":
+		staticNodes := map[string]map[string]*RegistryNode{}
+		for app, nodes := range config.StaticNodes {
+			staticNodes[app] = map[string]*RegistryNode{}
+			for addr, weight := range nodes {
+				staticNodes[app][addr] = &RegistryNode{Weight: weight}
+			}
+		}
+		return NewStaticRegistry(staticNodes)
+	default:
+		registry, err := NewRedisRegistry(config.Registry, config.RegistryPrefix, config.RegistryTTL)
+		if err != nil {
+			log.Printf("DISCOVER	Registry failed	%s	%s", config.Registry, err)
+			return nil
+		}
+		return registry
+	}
+}
+
+func copyNodes(nodes map[string]*RegistryNode) map[string]*RegistryNode {
+	copied := make(map[string]*RegistryNode, len(nodes))
+	for addr, node := range nodes {
+		copied[addr] = node
+	}
+	return copied
+}
@@ -0,0 +1,144 @@
+package s
+
+import (
+	"context"
+	"github.com/ssgo/base"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 幂等键，同一次调用的每次尝试使用相同的值，携带幂等键的请求可以安全的重试，接收方需要根据幂等键去重
+const idempotencyHeader = "Idempotency-Key"
+
+// 应用的重试策略，根据 Calls 中的配置创建
+// retryTimes 最多尝试的次数（默认尝试每个节点一次），retryMethods 可以重试的方法（默认 GET,HEAD,OPTIONS,PUT,DELETE，带有幂等键的请求总是可以重试）
+// retryStatus 需要重试的状态码（默认 502,503,504，连接失败总是重试），retryBackoff 第一次重试前等待的时间（毫秒，之后指数增长并随机抖动，默认不等待）
+// retryMaxBackoff 最长的等待时间（毫秒，默认为 retryBackoff 的 10 倍），retryBudget 当前进程中重试数量占请求数量的最大比例（默认不限制）
+type retryPolicy struct {
+	maxAttempts int
+	methods     map[string]bool
+	statuses    map[int]bool
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	budget      *localRetryBudget
+}
+
+func makeRetryPolicy(retryTimes int, retryMethods, retryStatus string, retryBackoff, retryMaxBackoff int, retryBudgetRatio float64) *retryPolicy {
+	if retryMethods == "" {
+		retryMethods = "GET,HEAD,OPTIONS,PUT,DELETE"
+	}
+	if retryStatus == "" {
+		retryStatus = "502,503,504"
+	}
+	policy := &retryPolicy{maxAttempts: retryTimes, methods: map[string]bool{}, statuses: map[int]bool{}}
+	for _, method := range strings.Split(retryMethods, ",") {
+		policy.methods[strings.ToUpper(strings.TrimSpace(method))] = true
+	}
+	for _, status := range strings.Split(retryStatus, ",") {
+		if statusCode, err := strconv.Atoi(strings.TrimSpace(status)); err == nil {
+			policy.statuses[statusCode] = true
+		}
+	}
+	policy.backoff = time.Duration(retryBackoff) * time.Millisecond
+	policy.maxBackoff = time.Duration(retryMaxBackoff) * time.Millisecond
+	if policy.maxBackoff <= 0 {
+		policy.maxBackoff = policy.backoff * 10
+	}
+	if retryBudgetRatio > 0 {
+		policy.budget = &localRetryBudget{ratio: retryBudgetRatio, tokens: localRetryBudgetTokens}
+	}
+	return policy
+}
+
+var defaultRetryPolicy = makeRetryPolicy(0, "", "", 0, 0, 0)
+
+// 请求失败后是否可以重试
+func (policy *retryPolicy) retryable(method string, headers []string, err error, statusCode int) bool {
+	if err == nil && !policy.statuses[statusCode] {
+		return false
+	}
+	return policy.idempotent(method, headers)
+}
+
+// 请求是否可以重复发送，方法在 retryMethods 中或者带有不为空的幂等键
+func (policy *retryPolicy) idempotent(method string, headers []string) bool {
+	if policy.methods[method] {
+		return true
+	}
+	for i := 0; i < len(headers)-1; i += 2 {
+		if http.CanonicalHeaderKey(headers[i]) == idempotencyHeader && headers[i+1] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 第 attempts 次重试前等待，使用指数退避和完全随机抖动，Context 结束时返回 false
+func (policy *retryPolicy) wait(ctx context.Context, attempts int) bool {
+	if policy.backoff <= 0 {
+		return true
+	}
+	backoff := policy.backoff << uint(attempts-1)
+	if backoff > policy.maxBackoff || backoff <= 0 {
+		backoff = policy.maxBackoff
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// 重试预算中最多保存的令牌数量（也是初始值），请求量小时也可以少量重试
+const localRetryBudgetTokens = 10
+
+// 应用的重试预算，每个请求存入 ratio 个令牌，每次重试消耗一个令牌，防止节点故障时重试放大流量
+// 预算只在当前进程中计算，不在调用方之间共享，N 个调用方实例时集群的重试量最多为单个实例的 N 倍
+type localRetryBudget struct {
+	lock   sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func (budget *localRetryBudget) deposit() {
+	if budget == nil {
+		return
+	}
+	budget.lock.Lock()
+	budget.tokens += budget.ratio
+	if budget.tokens > localRetryBudgetTokens {
+		budget.tokens = localRetryBudgetTokens
+	}
+	budget.lock.Unlock()
+}
+
+func (budget *localRetryBudget) withdraw() bool {
+	if budget == nil {
+		return true
+	}
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	if budget.tokens < 1 {
+		return false
+	}
+	budget.tokens--
+	return true
+}
+
+// 使用幂等键调用，非幂等的请求（例如 POST）也可以在失败时重试，每次重试发送相同的幂等键，key 为空时自动生成
+// 框架不会根据幂等键去重，接收方需要自行去重
+func (caller *Caller) WithIdempotencyKey(key string) *Caller {
+	if key == "" {
+		key = base.UniqueId()
+	}
+	newCaller := *caller
+	newCaller.headers = append(append(make([]string, 0, len(caller.headers)+2), caller.headers...), idempotencyHeader, key)
+	return &newCaller
+}
@@ -0,0 +1,295 @@
+package s
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 按 / 分段的路由树，查找时依次匹配静态的段、带约束的参数段、任意内容的参数段、匹配剩余路径的规则，同类的规则按注册顺序匹配
+type routeTree struct {
+	root *routeNode
+}
+
+type routeNode struct {
+	statics   map[string]*routeNode
+	params    []*routeNode
+	catchAlls []*routeNode
+	pattern   string
+	matcher   *regexp.Regexp
+	groups    []int
+	value     interface{}
+}
+
+// 路径参数，{name} 匹配一段中的任意内容，{name:int}、{name:float} 匹配数字，{name:*} 匹配剩余的所有路径，其他为正则表达式，例如 {slug:[a-z-]+}
+type routeArg struct {
+	name string
+	kind string
+}
+
+const plainRoutePattern = "^(.+?)$"
+
+func newRouteTree() *routeTree {
+	return &routeTree{root: &routeNode{}}
+}
+
+func splitRoutePath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// 解析路径中的参数，返回参数之间的文字（比参数多一个）和参数
+func parseRouteArgs(path string) ([]string, []routeArg) {
+	texts := make([]string, 0)
+	args := make([]routeArg, 0)
+	lastIndex := 0
+	for i := 0; i < len(path); i++ {
+		if path[i] != '{' {
+			continue
+		}
+		// 正则表达式中可能包含 {}
+		depth := 0
+		end := -1
+		for j := i; j < len(path) && end == -1; j++ {
+			if path[j] == '{' {
+				depth++
+			} else if path[j] == '}' {
+				depth--
+				if depth == 0 {
+					end = j
+				}
+			}
+		}
+		if end == -1 {
+			break
+		}
+		arg := routeArg{name: path[i+1 : end]}
+		if pos := strings.IndexByte(arg.name, ':'); pos != -1 {
+			arg.name, arg.kind = arg.name[0:pos], arg.name[pos+1:]
+		}
+		texts = append(texts, path[lastIndex:i])
+		args = append(args, arg)
+		lastIndex = end + 1
+		i = end
+	}
+	texts = append(texts, path[lastIndex:])
+	return texts, args
+}
+
+func (arg *routeArg) pattern() string {
+	switch arg.kind {
+	case "":
+		return ".+?"
+	case "int":
+		return "-?[0-9]+"
+	case "float":
+		return "-?[0-9]+(?:\\.[0-9]+)?"
+	case "*":
+		return ".*"
+	default:
+		return arg.kind
+	}
+}
+
+// 参数的值，int、float 转换为数字
+func (arg *routeArg) value(value string) interface{} {
+	switch arg.kind {
+	case "int":
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return v
+		}
+	case "float":
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return v
+		}
+	}
+	return value
+}
+
+// 按参数名设置匹配到的参数
+func setRouteArgs(args map[string]interface{}, routeArgs []routeArg, values []string) {
+	for i, arg := range routeArgs {
+		if i < len(values) {
+			args[arg.name] = arg.value(values[i])
+		}
+	}
+}
+
+// 添加路由，返回路由的节点和参数
+func (tree *routeTree) add(path string) (*routeNode, []routeArg, error) {
+	node := tree.root
+	routeArgs := make([]routeArg, 0)
+	segments := splitRoutePath(path)
+	for i, segment := range segments {
+		texts, segmentArgs := parseRouteArgs(segment)
+		if len(segmentArgs) == 0 {
+			node = node.staticChild(segment)
+			continue
+		}
+		routeArgs = append(routeArgs, segmentArgs...)
+
+		// 整段为 {name:*} 时匹配剩余的所有路径
+		if len(segmentArgs) == 1 && segmentArgs[0].kind == "*" && segment == "{"+segmentArgs[0].name+":*}" {
+			if i != len(segments)-1 {
+				return nil, nil, fmt.Errorf("catch-all %s must be the last segment of %s", segment, path)
+			}
+			child, err := node.child(&node.catchAlls, "^(.*)$", nil)
+			return child, routeArgs, err
+		}
+
+		pattern := "^"
+		for i, arg := range segmentArgs {
+			pattern += regexp.QuoteMeta(texts[i]) + "(" + arg.pattern() + ")"
+		}
+		pattern += regexp.QuoteMeta(texts[len(texts)-1]) + "$"
+		child, err := node.child(&node.params, pattern, segmentArgs)
+		if err != nil {
+			return nil, nil, err
+		}
+		node = child
+	}
+	return node, routeArgs, nil
+}
+
+// 添加正则表达式路由，开头的静态段之后的部分使用正则匹配剩余的路径
+func (tree *routeTree) addRegex(path string) (*routeNode, error) {
+	node := tree.root
+	segments := splitRoutePath(path)
+	for i, segment := range segments {
+		if regexp.QuoteMeta(segment) != segment {
+			return node.child(&node.catchAlls, "^"+strings.Join(segments[i:], "/")+"$", nil)
+		}
+		node = node.staticChild(segment)
+	}
+	return node, nil
+}
+
+// 添加前缀路由，匹配该路径以及下级的所有路径
+func (tree *routeTree) addPrefix(path string) *routeNode {
+	node := tree.root
+	for _, segment := range splitRoutePath(strings.TrimSuffix(path, "/")) {
+		if segment != "" {
+			node = node.staticChild(segment)
+		}
+	}
+	child, _ := node.child(&node.catchAlls, "", nil)
+	return child
+}
+
+// 查找路由，返回节点和按顺序匹配到的参数
+func (tree *routeTree) find(path string) (*routeNode, []string) {
+	return tree.root.find(strings.TrimPrefix(path, "/"), false, nil)
+}
+
+func (node *routeNode) staticChild(segment string) *routeNode {
+	if node.statics == nil {
+		node.statics = make(map[string]*routeNode)
+	}
+	child := node.statics[segment]
+	if child == nil {
+		child = &routeNode{}
+		node.statics[segment] = child
+	}
+	return child
+}
+
+// 相同规则的路由使用同一个节点，带约束的参数段排在任意内容的参数段之前
+func (node *routeNode) child(children *[]*routeNode, pattern string, args []routeArg) (*routeNode, error) {
+	for _, child := range *children {
+		if child.pattern == pattern {
+			return child, nil
+		}
+	}
+	child := &routeNode{pattern: pattern}
+	if pattern != "" {
+		matcher, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		child.matcher = matcher
+
+		// 正则表达式中的分组不作为参数
+		if args != nil {
+			group := 1
+			for _, arg := range args {
+				child.groups = append(child.groups, group)
+				argMatcher, err := regexp.Compile(arg.pattern())
+				if err != nil {
+					return nil, err
+				}
+				group += argMatcher.NumSubexp() + 1
+			}
+			if group != matcher.NumSubexp()+1 {
+				return nil, fmt.Errorf("bad route pattern %s", pattern)
+			}
+		}
+	}
+
+	index := len(*children)
+	if pattern != plainRoutePattern {
+		for i, c := range *children {
+			if c.pattern == plainRoutePattern {
+				index = i
+				break
+			}
+		}
+	}
+	*children = append(*children, nil)
+	copy((*children)[index+1:], (*children)[index:])
+	(*children)[index] = child
+	return child, nil
+}
+
+// 匹配到的参数
+func (node *routeNode) values(finds []string) []string {
+	if node.groups == nil {
+		return finds[1:]
+	}
+	values := make([]string, len(node.groups))
+	for i, group := range node.groups {
+		values[i] = finds[group]
+	}
+	return values
+}
+
+// path 为该节点之后剩余的路径，done 表示路径已经结束
+func (node *routeNode) find(path string, done bool, args []string) (*routeNode, []string) {
+	if done {
+		if node.value != nil {
+			return node, args
+		}
+	} else {
+		segment, rest, hasRest := path, "", false
+		if pos := strings.IndexByte(path, '/'); pos != -1 {
+			segment, rest, hasRest = path[0:pos], path[pos+1:], true
+		}
+		if child := node.statics[segment]; child != nil {
+			if found, foundArgs := child.find(rest, !hasRest, args); found != nil {
+				return found, foundArgs
+			}
+		}
+		for _, child := range node.params {
+			if finds := child.matcher.FindStringSubmatch(segment); finds != nil {
+				if found, foundArgs := child.find(rest, !hasRest, append(args, child.values(finds)...)); found != nil {
+					return found, foundArgs
+				}
+			}
+		}
+	}
+	// 前缀路由包含该路径本身，其他规则只匹配下级的路径
+	for _, child := range node.catchAlls {
+		if child.value == nil {
+			continue
+		}
+		if child.matcher == nil {
+			return child, args
+		}
+		if done {
+			continue
+		}
+		if finds := child.matcher.FindStringSubmatch(path); finds != nil {
+			return child, append(args, child.values(finds)...)
+		}
+	}
+	return nil, nil
+}
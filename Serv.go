@@ -1,43 +1,153 @@
 package s
 
 import (
+	"bufio"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
 	"github.com/ssgo/base"
-	"golang.org/x/net/websocket"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type routeHandler struct {
 	webRequestingNum int64
+	stopping         int32
 	wsConns          map[string]*websocket.Conn
-	// TODO 记录正在处理的请求数量，连接中的WS数量，在关闭服务时能优雅的结束
+	wsConnsLock      sync.Mutex
 }
 
+// 停止接收新请求，并通知所有 Websocket 客户端关闭连接
 func (rh *routeHandler) Stop() {
+	atomic.StoreInt32(&rh.stopping, 1)
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server stopping")
+	rh.wsConnsLock.Lock()
 	for _, conn := range rh.wsConns {
-		conn.Close()
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
 	}
+	rh.wsConnsLock.Unlock()
 }
 
-func (rh *routeHandler) Wait() {
-	for i := 0; i < 25; i++ {
-		if rh.webRequestingNum == 0 && len(rh.wsConns) == 0 {
-			break
+// 等待正在处理的请求和 Websocket 连接结束，超时返回 false
+func (rh *routeHandler) Wait(timeout time.Duration) bool {
+	endTime := time.Now().Add(timeout)
+	for {
+		rh.wsConnsLock.Lock()
+		wsNum := len(rh.wsConns)
+		rh.wsConnsLock.Unlock()
+		if atomic.LoadInt64(&rh.webRequestingNum) == 0 && wsNum == 0 {
+			return true
+		}
+		if time.Now().After(endTime) {
+			return false
 		}
-		time.Sleep(time.Millisecond * 200)
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// 强制关闭剩余的 Websocket 连接，返回未完成的请求数量和被关闭的连接
+func (rh *routeHandler) Abort() (int64, []string) {
+	wsAddrs := make([]string, 0)
+	rh.wsConnsLock.Lock()
+	for addr, conn := range rh.wsConns {
+		conn.Close()
+		wsAddrs = append(wsAddrs, addr)
+	}
+	rh.wsConnsLock.Unlock()
+	return atomic.LoadInt64(&rh.webRequestingNum), wsAddrs
+}
+
+func (rh *routeHandler) addWsConn(conn *websocket.Conn) {
+	rh.wsConnsLock.Lock()
+	if rh.wsConns == nil {
+		rh.wsConns = map[string]*websocket.Conn{}
 	}
+	rh.wsConns[conn.RemoteAddr().String()] = conn
+	rh.wsConnsLock.Unlock()
+}
+
+func (rh *routeHandler) removeWsConn(conn *websocket.Conn) {
+	rh.wsConnsLock.Lock()
+	delete(rh.wsConns, conn.RemoteAddr().String())
+	rh.wsConnsLock.Unlock()
+}
+
+// 记录输出的状态码，服务直接操作 http.ResponseWriter 时也能记录到日志中
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, fmt.Errorf("Hijack Not Supported")
 }
 
 func (rh *routeHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 	startTime := time.Now()
 
+	// 服务停止中，拒绝新的请求（调用方会重试其他节点）
+	if atomic.LoadInt32(&rh.stopping) == 1 {
+		response.Header().Set("Connection", "close")
+		response.WriteHeader(503)
+		return
+	}
+
+	// 内置的健康检查接口，不记录日志
+	if request.URL.Path == config.HealthPath {
+		response.Write([]byte("OK"))
+		return
+	}
+
+	statusWriter := &statusResponseWriter{ResponseWriter: response}
+	response = statusWriter
+
+	// 上游传递了剩余超时时间时，在请求的 Context 中生效，并继续传递给下游
+	request, cancel := withRequestDeadline(request)
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// 记录正在处理的请求数量，Websocket 连接建立后改为记录在 wsConns 中
+	atomic.AddInt64(&rh.webRequestingNum, 1)
+	isRequesting := true
+	defer func() {
+		if isRequesting {
+			atomic.AddInt64(&rh.webRequestingNum, -1)
+		}
+	}()
+
 	// Headers，未来可以优化日志记录，最近访问过的头部信息可省略
 	headers := make(map[string]string)
 	for k, v := range request.Header {
@@ -65,56 +175,54 @@ func (rh *routeHandler) ServeHTTP(response http.ResponseWriter, request *http.Re
 	args := make(map[string]interface{})
 
 	// 查找 Proxy
-	proxyToApp, proxyToPath := findProxy(requestPath)
+	proxy, proxyToPath := findProxy(requestPath)
 
-	// 先看缓存中是否有 Service
+	// 查找 Service 和 WebsocketService
 	var s *webServiceType
+	var services map[string]*webServiceType
 	var ws *websocketServiceType
-	if proxyToApp == nil {
-		s = webServices[requestPath]
-		if s == nil {
-			ws = websocketServices[requestPath]
-		}
-	}
-
-	// 未匹配到缓存，尝试匹配新的 Service
-	if proxyToApp == nil && s == nil && ws == nil {
-		for _, tmpS := range regexWebServices {
-			finds := tmpS.pathMatcher.FindAllStringSubmatch(requestPath, 20)
-			if len(finds) > 0 {
-				foundArgs := finds[0]
-				for i := 1; i < len(foundArgs); i++ {
-					//log.Println("  >>>>", tmpS.pathArgs[i-1], foundArgs[i])
-					args[tmpS.pathArgs[i-1]] = foundArgs[i]
-					s = tmpS
-				}
-				break
-			}
-		}
-	}
-
-	// 未匹配到缓存和Service，尝试匹配新的WebsocketService
-	if proxyToApp == nil && s == nil && ws == nil {
-		for _, tmpS := range regexWebsocketServices {
-			finds := tmpS.pathMatcher.FindAllStringSubmatch(requestPath, 20)
-			if len(finds) > 0 {
-				foundArgs := finds[0]
-				for i := 1; i < len(foundArgs); i++ {
-					args[tmpS.pathArgs[i-1]] = foundArgs[i]
-					ws = tmpS
-				}
-				break
+	var pathValues []string
+	if proxy == nil {
+		var node *routeNode
+		if node, pathValues = serviceRoutes.find(requestPath); node != nil {
+			routes := node.value.(*routeServices)
+			if routes.web != nil {
+				services = routes.web
+			} else {
+				ws = routes.websocket
+				setRouteArgs(args, ws.pathArgs, pathValues)
 			}
 		}
 	}
 
 	// 全都未匹配，输出404
-	if proxyToApp == nil && s == nil && ws == nil {
+	if proxy == nil && services == nil && ws == nil {
 		writeLog("FAIL", nil, false, request, &response, &args, &headers, &startTime, 0, 404)
 		response.WriteHeader(404)
 		return
 	}
 
+	// 路径存在但没有对应方法的服务，OPTIONS 返回允许的方法，其他方法输出405
+	if services != nil {
+		var allowMethods []string
+		s, allowMethods = selectWebService(request.Method, services)
+		if s != nil {
+			setRouteArgs(args, s.pathArgs, pathValues)
+		} else {
+			response.Header().Set("Allow", strings.Join(allowMethods, ", "))
+			if request.Method == "OPTIONS" {
+				if recordLogs {
+					writeLog("ACCESS", nil, false, request, &response, &args, &headers, &startTime, 0, 204)
+				}
+				response.WriteHeader(204)
+			} else {
+				writeLog("FAIL", nil, false, request, &response, &args, &headers, &startTime, 0, 405)
+				response.WriteHeader(405)
+			}
+			return
+		}
+	}
+
 	// GET POST
 	request.ParseForm()
 	for k, v := range request.Form {
@@ -152,9 +260,19 @@ func (rh *routeHandler) ServeHTTP(response http.ResponseWriter, request *http.Re
 		}
 	}
 
-	// 前置过滤器
+	// 路由所在的分组
+	var group *Group
+	if proxy != nil {
+		group = proxy.group
+	} else if ws != nil {
+		group = ws.group
+	} else if s != nil {
+		group = s.group
+	}
+
+	// 前置过滤器，包括路由所在分组的
 	var result interface{} = nil
-	for _, filter := range inFilters {
+	for _, filter := range group.getInFilters() {
 		result = filter(&args, request, &response)
 		if result != nil {
 			break
@@ -164,7 +282,12 @@ func (rh *routeHandler) ServeHTTP(response http.ResponseWriter, request *http.Re
 	// 身份认证
 	var authLevel uint = 0
 	if webAuthChecker != nil {
-		if ws != nil {
+		// 只有分组中的代理进行身份认证，全局的代理保持不认证
+		if proxy != nil {
+			if proxy.group != nil {
+				authLevel = proxy.authLevel
+			}
+		} else if ws != nil {
 			authLevel = ws.authLevel
 		} else if s != nil {
 			authLevel = s.authLevel
@@ -182,14 +305,23 @@ func (rh *routeHandler) ServeHTTP(response http.ResponseWriter, request *http.Re
 
 	// 处理 Proxy
 	var logName string
-	if proxyToApp != nil {
+	statusCode := http.StatusOK
+	if proxy != nil {
 		caller := &Caller{request: request}
-		result = caller.Do(request.Method, *proxyToApp, *proxyToPath, args, "S-Unique-Id", request.Header.Get("S-Unique-Id")).Bytes()
+		r := caller.Do(request.Method, proxy.toApp, *proxyToPath, args, "S-Unique-Id", request.Header.Get("S-Unique-Id"))
+		if r.Response != nil {
+			statusCode = r.Response.StatusCode
+			result = r.Bytes()
+		} else {
+			result = NewHttpError(http.StatusBadGateway, 0, http.StatusText(http.StatusBadGateway))
+		}
 		logName = "PROXY"
 	} else {
 		// 处理 Websocket
 		if ws != nil && result == nil {
-			doWebsocketService(ws, request, &response, &args, &headers, &startTime)
+			isRequesting = false
+			atomic.AddInt64(&rh.webRequestingNum, -1)
+			doWebsocketService(rh, ws, request, &response, &args, &headers, &startTime)
 		} else if s != nil || result != nil {
 			result = doWebService(s, request, &response, &args, &headers, result, &startTime)
 			logName = "ACCESS"
@@ -197,8 +329,8 @@ func (rh *routeHandler) ServeHTTP(response http.ResponseWriter, request *http.Re
 	}
 
 	if ws == nil {
-		// 后置过滤器
-		for _, filter := range outFilters {
+		// 后置过滤器，包括路由所在分组的
+		for _, filter := range group.getOutFilters() {
 			newResult, done := filter(&args, request, &response, result)
 			if newResult != nil {
 				result = newResult
@@ -208,6 +340,14 @@ func (rh *routeHandler) ServeHTTP(response http.ResponseWriter, request *http.Re
 			}
 		}
 
+		// 返回错误时输出对应的状态码和标准错误内容
+		if err, ok := result.(error); ok {
+			if _, isHttpError := err.(*HttpError); !isHttpError {
+				log.Print("ERROR	", request.Method, "	", request.RequestURI, "	", err)
+			}
+			statusCode, result = makeErrorResult(err)
+		}
+
 		// 返回结果
 		outType := reflect.TypeOf(result)
 		if outType.Kind() == reflect.Ptr {
@@ -229,6 +369,9 @@ func (rh *routeHandler) ServeHTTP(response http.ResponseWriter, request *http.Re
 			zipWriter, err := gzip.NewWriterLevel(response, 1)
 			if err == nil {
 				response.Header().Set("Content-Encoding", "gzip")
+				if statusWriter.status == 0 && statusCode != http.StatusOK {
+					response.WriteHeader(statusCode)
+				}
 				zipWriter.Write(outBytes)
 				zipWriter.Close()
 				isZipOuted = true
@@ -236,18 +379,24 @@ func (rh *routeHandler) ServeHTTP(response http.ResponseWriter, request *http.Re
 		}
 
 		if !isZipOuted {
+			if statusWriter.status == 0 && statusCode != http.StatusOK {
+				response.WriteHeader(statusCode)
+			}
 			response.Write(outBytes)
 		}
 
-		// 记录访问日志
+		// 记录访问日志，服务自己输出了状态码时以实际输出的为准
+		if statusWriter.status != 0 {
+			statusCode = statusWriter.status
+		}
 		if recordLogs {
-			writeLog(logName, outBytes, isJson, request, &response, &args, &headers, &startTime, authLevel, 200)
+			writeLog(logName, outBytes, isJson, request, &response, &args, &headers, &startTime, authLevel, statusCode)
 		}
 	}
 
-	if sessionObjects[request] != nil {
-		delete(sessionObjects, request)
-	}
+	sessionObjectsLock.Lock()
+	delete(sessionObjects, request)
+	sessionObjectsLock.Unlock()
 }
 
 func writeLog(logName string, outBytes []byte, isJson bool, request *http.Request, response *http.ResponseWriter, args *map[string]interface{}, headers *map[string]string, startTime *time.Time, authLevel uint, statusCode int) {
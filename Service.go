@@ -1,6 +1,7 @@
 package s
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/ssgo/base"
@@ -26,6 +27,7 @@ var config = struct {
 	RwTimeout        int
 	KeepaliveTimeout int
 	CallTimeout      int
+	StopTimeout      int
 	LogFile          string
 	NoLogHeaders     string
 	LogResponseSize  int
@@ -34,13 +36,41 @@ var config = struct {
 	KeyFile          string
 	Registry         string
 	RegistryPrefix   string
+	RegistryTTL      int
+	StaticNodes      map[string]map[string]int
+	HealthPath       string
 	AccessTokens     map[string]uint
 	App              string
 	Weight           uint
+	Meta             map[string]string
 	Calls            map[string]struct {
-		AccessToken string
-		Timeout     int
-		HttpVersion int
+		AccessToken     string
+		Timeout         int
+		HttpVersion     int
+		BreakFailures   int
+		BreakTimeout    int
+		HealthPath      string
+		HealthInterval  int
+		HealthFailures  int
+		LoadBalancer    string
+		HashHeader      string
+		HashSession     bool
+		Filter          string
+		Prefer          string
+		CanaryApp       string
+		CanaryFilter    string
+		CanaryPercent   float64
+		CanaryHeader    string
+		CanarySticky    bool
+		RetryTimes      int
+		RetryMethods    string
+		RetryStatus     string
+		RetryBackoff    int
+		RetryMaxBackoff int
+		RetryBudget     float64
+		HedgeDelay      int
+		HedgePercentile float64
+		Interceptors    string
 	}
 }{}
 var noLogHeaders = map[string]bool{}
@@ -66,6 +96,7 @@ type AsyncServer struct {
 
 func (as *AsyncServer) Stop() {
 	if as.listener != nil {
+		unregisterDiscover(as.Addr)
 		as.listener.Close()
 	}
 	if as.stopChan != nil {
@@ -143,10 +174,22 @@ func initConfig() {
 		config.CallTimeout = 5000
 	}
 
+	if config.StopTimeout <= 0 {
+		config.StopTimeout = 5000
+	}
+
 	if config.Registry == "" {
 		config.Registry = "discover:15"
 	}
 
+	if config.RegistryTTL <= 0 {
+		config.RegistryTTL = 15000
+	}
+
+	if config.HealthPath == "" {
+		config.HealthPath = "/_health"
+	}
+
 	if config.Weight <= 0 {
 		config.Weight = 1
 	}
@@ -166,6 +209,11 @@ func initConfig() {
 func start(httpVersion int, as *AsyncServer) error {
 	initConfig()
 
+	// 由 sclient 命令使用 sclient 标签编译时只生成客户端代码，不启动服务
+	if makeClientOnStart != nil && as == nil {
+		makeClientOnStart()
+	}
+
 	log.Printf("SERVER	[%s]	Starting...", config.Listen)
 
 	rh := routeHandler{}
@@ -197,13 +245,6 @@ func start(httpVersion int, as *AsyncServer) error {
 		return err
 	}
 
-	closeChan := make(chan os.Signal, 2)
-	signal.Notify(closeChan, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-closeChan
-		listener.Close()
-	}()
-
 	addrInfo := listener.Addr().(*net.TCPAddr)
 	ip := addrInfo.IP
 	port := addrInfo.Port
@@ -219,6 +260,15 @@ func start(httpVersion int, as *AsyncServer) error {
 	}
 	serverAddr := fmt.Sprintf("%s:%d", ip.String(), port)
 
+	closeChan := make(chan os.Signal, 2)
+	signal.Notify(closeChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-closeChan
+		// 先注销节点再停止接收新连接
+		unregisterDiscover(serverAddr)
+		listener.Close()
+	}()
+
 	if startDiscover(serverAddr) == false {
 		log.Printf("SERVER	Failed to start discover")
 	}
@@ -264,11 +314,21 @@ func start(httpVersion int, as *AsyncServer) error {
 	}
 
 	log.Printf("SERVER	%s	Stopping", serverAddr)
-	stopDiscover()
+	signal.Stop(closeChan)
 	rh.Stop()
 
-	rh.Wait()
-	waitDiscover()
+	// 等待正在处理的请求结束并正常关闭空闲的长连接，Websocket 连接已从 srv 中脱离，由 rh.Wait 等待，超时后强制关闭
+	stopCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.StopTimeout)*time.Millisecond)
+	stopDeadline, _ := stopCtx.Deadline()
+	err = srv.Shutdown(stopCtx)
+	cancel()
+	if err != nil || !rh.Wait(time.Until(stopDeadline)) {
+		requestingNum, wsAddrs := rh.Abort()
+		log.Printf("SERVER	%s	Forced	%d	%d	%s", serverAddr, requestingNum, len(wsAddrs), strings.Join(wsAddrs, ","))
+		srv.Close()
+	}
+
+	stopDiscover(serverAddr)
 	log.Printf("SERVER	%s	Stopped", serverAddr)
 	if as != nil {
 		as.stopChan <- true
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -25,22 +27,26 @@ import (
 func ResetAllSets() {
 	rewrites = make(map[string]*rewriteInfo)
 	regexRewrites = make(map[string]*rewriteInfo)
-	proxies = make(map[string]*proxyInfo, 0)
-	regexProxies = make(map[string]*proxyInfo, 0)
-	statics = make(map[string]*string)
+	proxyRoutes = newRouteTree()
+	staticRoutes = newRouteTree()
 	sessionKey = ""
 	sessionCreator = nil
+	sessionObjectsLock.Lock()
 	sessionObjects = map[*http.Request]map[reflect.Type]interface{}{}
+	sessionObjectsLock.Unlock()
 	injectObjects = map[reflect.Type]interface{}{}
 
-	webServices = make(map[string]*webServiceType)
-	regexWebServices = make(map[string]*webServiceType)
+	webServices = make(map[string]map[string]*webServiceType)
+	serviceRoutes = newRouteTree()
 	inFilters = make([]func(*map[string]interface{}, *http.Request, *http.ResponseWriter) interface{}, 0)
 	outFilters = make([]func(*map[string]interface{}, *http.Request, *http.ResponseWriter, interface{}) (interface{}, bool), 0)
 
-	websocketServices = make(map[string]*websocketServiceType)
-	regexWebsocketServices = make(map[string]*websocketServiceType)
 	webAuthChecker = nil
+	settedRegistry = nil
+	settedLoadBalancer = &DefaultLoadBalancer{}
+	globalClientInterceptors.Store([]ClientInterceptor{})
+	settedMock = nil
+	namedClientInterceptors = map[string]ClientInterceptor{}
 	webSocketActionAuthChecker = nil
 	recordLogs = true
 }
@@ -137,3 +143,114 @@ func (t *Testing) Test(tests bool, comment string, addons ...interface{}) {
 		fmt.Println("  \x1b[0;42m成功\x1b[0m", comment)
 	}
 }
+
+// 模拟调用中的一次调用记录
+type MockCall struct {
+	App     string
+	Method  string
+	Path    string
+	Data    interface{}
+	Headers map[string]string
+}
+
+// 模拟下游服务，Caller 使用 Mock 时不发起请求，由设置的应答返回结果，并记录所有的调用
+type Mock struct {
+	lock     sync.Mutex
+	handlers map[string]func(call *MockCall) *Result
+	calls    []*MockCall
+}
+
+var settedMock *Mock
+
+func NewMock() *Mock {
+	return &Mock{handlers: map[string]func(call *MockCall) *Result{}}
+}
+
+// 设置所有 Caller 都使用的 Mock，用于测试 AsyncStart 启动的服务，设置为 nil 时恢复
+func SetMock(mock *Mock) {
+	settedMock = mock
+}
+
+// 获得一个使用 Mock 的 Caller，可以直接传递给服务方法进行测试
+func (mock *Mock) Caller() *Caller {
+	return &Caller{mock: mock}
+}
+
+// 设置固定的应答，response 与服务方法的返回值相同（string、[]byte 直接返回，其他类型返回 JSON），path 为空时匹配应用的所有路径
+func (mock *Mock) Set(app, path string, response interface{}) {
+	var data []byte
+	switch v := response.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		data = makeBytesResult(v)
+	}
+	mock.SetFunc(app, path, func(call *MockCall) *Result {
+		return NewResult(200, data)
+	})
+}
+
+// 设置由函数产生的应答，path 为空时匹配应用的所有路径
+func (mock *Mock) SetFunc(app, path string, handler func(call *MockCall) *Result) {
+	mock.lock.Lock()
+	mock.handlers[app+"\t"+path] = handler
+	mock.lock.Unlock()
+}
+
+// 获取所有的调用记录
+func (mock *Mock) Calls() []MockCall {
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	calls := make([]MockCall, len(mock.calls))
+	for i, call := range mock.calls {
+		calls[i] = *call
+	}
+	return calls
+}
+
+// 清除调用记录
+func (mock *Mock) ResetCalls() {
+	mock.lock.Lock()
+	mock.calls = nil
+	mock.lock.Unlock()
+}
+
+// 记录调用并返回应答，没有设置应答时返回 404
+func (mock *Mock) do(method, app, path string, data interface{}, headers []string) *Result {
+	call := &MockCall{App: app, Method: method, Path: path, Data: data, Headers: map[string]string{}}
+	for i := 1; i < len(headers); i += 2 {
+		call.Headers[headers[i-1]] = headers[i]
+	}
+
+	mock.lock.Lock()
+	mock.calls = append(mock.calls, call)
+	handler := mock.handlers[app+"\t"+path]
+	if handler == nil {
+		if pathIndex := strings.IndexByte(path, '?'); pathIndex != -1 {
+			handler = mock.handlers[app+"\t"+path[0:pathIndex]]
+		}
+	}
+	if handler == nil {
+		handler = mock.handlers[app+"\t"]
+	}
+	mock.lock.Unlock()
+
+	if handler == nil {
+		return NewResult(404, nil)
+	}
+	r := handler(call)
+	if r == nil {
+		r = NewResult(200, nil)
+	}
+	r.node = "mock"
+	return r
+}
+
+func (caller *Caller) getMock() *Mock {
+	if caller.mock != nil {
+		return caller.mock
+	}
+	return settedMock
+}
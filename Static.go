@@ -7,30 +7,19 @@ import (
 	"time"
 )
 
-var statics = make(map[string]*string)
+var staticRoutes = newRouteTree()
 
 func Static(path, rootPath string) {
-	statics[path] = &rootPath
+	staticRoutes.addPrefix(path).value = &rootPath
 }
 
 func processStatic(requestPath string, request *http.Request, response *http.ResponseWriter, headers *map[string]string, startTime *time.Time) bool {
-	if len(statics) == 0 {
-		return false
-	}
-
-	rootPath := statics[requestPath]
-	if rootPath == nil {
-		for p1, p2 := range statics {
-			if strings.HasPrefix(requestPath, p1) {
-				rootPath = p2
-				break
-			}
-		}
-	}
-
-	if rootPath == nil {
+	// 使用匹配的最长路径
+	node, _ := staticRoutes.find(requestPath)
+	if node == nil {
 		return false
 	}
+	rootPath := node.value.(*string)
 
 	filePath := *rootPath + requestPath
 	if strings.HasSuffix(filePath, "/") {
@@ -0,0 +1,32 @@
+package s
+
+// 使用固定节点的注册中心，不支持注册，适合没有 Redis 的环境
+type StaticRegistry struct {
+	nodes map[string]map[string]*RegistryNode
+}
+
+func NewStaticRegistry(nodes map[string]map[string]*RegistryNode) *StaticRegistry {
+	if nodes == nil {
+		nodes = map[string]map[string]*RegistryNode{}
+	}
+	return &StaticRegistry{nodes: nodes}
+}
+
+func (sr *StaticRegistry) Register(app, addr string, node *RegistryNode) bool {
+	return true
+}
+
+func (sr *StaticRegistry) Unregister(app, addr string) bool {
+	return true
+}
+
+func (sr *StaticRegistry) Nodes(app string) map[string]*RegistryNode {
+	return copyNodes(sr.nodes[app])
+}
+
+func (sr *StaticRegistry) Watch(apps []string, onReset func(app string, nodes map[string]*RegistryNode), onChange func(app, addr string, node *RegistryNode)) func() {
+	for _, app := range apps {
+		onReset(app, sr.Nodes(app))
+	}
+	return func() {}
+}
@@ -9,14 +9,17 @@ import (
 	"net/http"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 type webServiceType struct {
 	authLevel     uint
-	pathMatcher   *regexp.Regexp
-	pathArgs      []string
+	method        string
+	group         *Group
+	pathArgs      []routeArg
 	parmsNum      int
 	inType        reflect.Type
 	inIndex       int
@@ -24,6 +27,8 @@ type webServiceType struct {
 	requestIndex  int
 	responseIndex int
 	callerIndex   int
+	contextIndex  int
+	errorIndex    int
 	funcType      reflect.Type
 	funcValue     reflect.Value
 }
@@ -35,13 +40,29 @@ type rewriteInfo struct {
 
 type proxyInfo struct {
 	authLevel uint
-	matcher   *regexp.Regexp
+	group     *Group
 	toApp     string
 	toPath    string
 }
 
-var webServices = make(map[string]*webServiceType)
-var regexWebServices = make(map[string]*webServiceType)
+// 路径 => 请求方法 => 服务，方法为空的服务处理所有的请求方法
+var webServices = make(map[string]map[string]*webServiceType)
+
+// Web 服务和 Websocket 服务使用同一个路由树，静态的段优先于参数段匹配，不会被另一类服务的参数路由覆盖
+var serviceRoutes = newRouteTree()
+
+// 路由节点上的服务，同一路径同时注册了两类服务时优先使用 Web 服务
+type routeServices struct {
+	web       map[string]*webServiceType
+	websocket *websocketServiceType
+}
+
+func getRouteServices(node *routeNode) *routeServices {
+	if node.value == nil {
+		node.value = &routeServices{}
+	}
+	return node.value.(*routeServices)
+}
 
 var inFilters = make([]func(*map[string]interface{}, *http.Request, *http.ResponseWriter) interface{}, 0)
 var outFilters = make([]func(*map[string]interface{}, *http.Request, *http.ResponseWriter, interface{}) (interface{}, bool), 0)
@@ -50,6 +71,7 @@ var webAuthChecker func(uint, *string, *map[string]interface{}, *http.Request) b
 var sessionKey string
 var sessionCreator func() string
 var sessionObjects = map[*http.Request]map[reflect.Type]interface{}{}
+var sessionObjectsLock sync.RWMutex
 var injectObjects = map[reflect.Type]interface{}{}
 
 // 设置 SessionKey，自动在 Header 中产生，AsyncStart 的客户端支持自动传递
@@ -76,6 +98,8 @@ func GetSessionId(request *http.Request) string {
 
 // 设置一个生命周期在 Request 中的对象，请求中可以使用对象类型注入参数方便调用
 func SetSessionInject(request *http.Request, obj interface{}) {
+	sessionObjectsLock.Lock()
+	defer sessionObjectsLock.Unlock()
 	if sessionObjects[request] == nil {
 		sessionObjects[request] = map[reflect.Type]interface{}{}
 	}
@@ -84,6 +108,8 @@ func SetSessionInject(request *http.Request, obj interface{}) {
 
 // 获取本生命周期中指定类型的 Session 对象
 func GetSessionInject(request *http.Request, dataType reflect.Type) interface{} {
+	sessionObjectsLock.RLock()
+	defer sessionObjectsLock.RUnlock()
 	if sessionObjects[request] == nil {
 		return nil
 	}
@@ -100,8 +126,18 @@ func GetInject(dataType reflect.Type) interface{} {
 	return injectObjects[dataType]
 }
 
-// 注册服务
+// 注册服务，处理所有的请求方法
 func Register(authLevel uint, path string, serviceFunc interface{}) {
+	RegisterByMethod("", authLevel, path, serviceFunc)
+}
+
+// 注册指定请求方法的服务，同一路径的不同方法可以使用不同的服务
+// 路径存在但没有对应方法的服务时返回 405，HEAD 请求使用 GET 的服务，OPTIONS 请求返回允许的方法（Allow）
+func RegisterByMethod(method string, authLevel uint, path string, serviceFunc interface{}) {
+	registerWebService(nil, method, authLevel, path, serviceFunc)
+}
+
+func registerWebService(group *Group, method string, authLevel uint, path string, serviceFunc interface{}) {
 	s, err := makeCachedService(serviceFunc)
 	if err != nil {
 		log.Printf("ERROR	%s	%s	", path, err)
@@ -109,25 +145,50 @@ func Register(authLevel uint, path string, serviceFunc interface{}) {
 	}
 
 	s.authLevel = authLevel
-	finder, err := regexp.Compile("\\{(.+?)\\}")
-	if err == nil {
-		keyName := regexp.QuoteMeta(path)
-		finds := finder.FindAllStringSubmatch(path, 20)
-		for _, found := range finds {
-			keyName = strings.Replace(keyName, regexp.QuoteMeta(found[0]), "(.+?)", 1)
-			s.pathArgs = append(s.pathArgs, found[1])
-		}
-		if len(s.pathArgs) > 0 {
-			s.pathMatcher, err = regexp.Compile("^" + keyName + "$")
-			if err != nil {
-				log.Print("Register	Compile	", err)
-			}
-			regexWebServices[path] = s
+	s.group = group
+	s.method = strings.ToUpper(method)
+
+	// 参数名不同的相同路径使用同一个节点，参数按各自服务的参数名设置
+	var node *routeNode
+	node, s.pathArgs, err = serviceRoutes.add(path)
+	if err != nil {
+		log.Print("Register	Compile	", err)
+		return
+	}
+	if webServices[path] == nil {
+		webServices[path] = make(map[string]*webServiceType)
+	}
+	webServices[path][s.method] = s
+	routes := getRouteServices(node)
+	if routes.web == nil {
+		routes.web = make(map[string]*webServiceType)
+	}
+	routes.web[s.method] = s
+}
+
+// 选择对应请求方法的服务，没有时返回允许的方法
+func selectWebService(method string, services map[string]*webServiceType) (*webServiceType, []string) {
+	if s := services[method]; s != nil {
+		return s, nil
+	}
+	if s := services["GET"]; s != nil && method == "HEAD" {
+		return s, nil
+	}
+	if s := services[""]; s != nil {
+		return s, nil
+	}
+
+	allowMethods := []string{"OPTIONS"}
+	for m := range services {
+		if m != "OPTIONS" {
+			allowMethods = append(allowMethods, m)
 		}
 	}
-	if s.pathMatcher == nil {
-		webServices[path] = s
+	if services["GET"] != nil && services["HEAD"] == nil {
+		allowMethods = append(allowMethods, "HEAD")
 	}
+	sort.Strings(allowMethods)
+	return nil, allowMethods
 }
 
 // 设置前置过滤器
@@ -171,6 +232,9 @@ func doWebService(service *webServiceType, request *http.Request, response *http
 			caller := &Caller{headers: []string{"S-Unique-Id", request.Header.Get("S-Unique-Id")}, request: request}
 			parms[service.callerIndex] = reflect.ValueOf(caller)
 		}
+		if service.contextIndex >= 0 {
+			parms[service.contextIndex] = reflect.ValueOf(request.Context())
+		}
 		for i, parm := range parms {
 			if parm.Kind() == reflect.Invalid {
 				st := service.funcType.In(i)
@@ -196,7 +260,9 @@ func doWebService(service *webServiceType, request *http.Request, response *http
 		if request.RequestURI == "/echo4" {
 		}
 		outs := service.funcValue.Call(parms)
-		if len(outs) > 0 {
+		if service.errorIndex != -1 && !outs[service.errorIndex].IsNil() {
+			result = outs[service.errorIndex].Interface()
+		} else if len(outs) > 0 && service.errorIndex != 0 {
 			result = outs[0].Interface()
 		} else {
 			result = ""
@@ -232,6 +298,7 @@ func makeCachedService(matchedServie interface{}) (*webServiceType, error) {
 	targetService.requestIndex = -1
 	targetService.responseIndex = -1
 	targetService.callerIndex = -1
+	targetService.contextIndex = -1
 	for i := 0; i < targetService.parmsNum; i++ {
 		t := funcType.In(i)
 		if t.String() == "*http.Request" {
@@ -242,6 +309,8 @@ func makeCachedService(matchedServie interface{}) (*webServiceType, error) {
 			targetService.headersIndex = i
 		} else if t.String() == "*s.Caller" {
 			targetService.callerIndex = i
+		} else if t.String() == "context.Context" {
+			targetService.contextIndex = i
 		} else if t.Kind() == reflect.Struct || (t.Kind() == reflect.Map && t.Elem().Kind() == reflect.Interface) {
 			if targetService.inType == nil {
 				targetService.inIndex = i
@@ -250,6 +319,14 @@ func makeCachedService(matchedServie interface{}) (*webServiceType, error) {
 		}
 	}
 
+	// 最后一个返回值为 error 或 *HttpError 时作为错误输出
+	targetService.errorIndex = -1
+	if n := funcType.NumOut(); n > 0 {
+		if t := funcType.Out(n - 1); t == errorType || t == reflect.TypeOf(&HttpError{}) {
+			targetService.errorIndex = n - 1
+		}
+	}
+
 	targetService.funcType = funcType
 	targetService.funcValue = reflect.ValueOf(matchedServie)
 	return targetService, nil
@@ -9,15 +9,13 @@ import (
 	"log"
 	"net/http"
 	"reflect"
-	"regexp"
-	"strings"
 	"time"
 )
 
 type websocketServiceType struct {
 	authLevel         uint
-	pathMatcher       *regexp.Regexp
-	pathArgs          []string
+	group             *Group
+	pathArgs          []routeArg
 	updater           *websocket.Upgrader
 	openParmsNum      int
 	openInType        reflect.Type
@@ -54,9 +52,6 @@ type ActionRegister struct {
 	websocketServiceType *websocketServiceType
 }
 
-var websocketServices = make(map[string]*websocketServiceType)
-var regexWebsocketServices = make(map[string]*websocketServiceType)
-
 var webSocketActionAuthChecker func(uint, *string, *string, *map[string]interface{}, *http.Request, interface{}) bool
 
 // 注册Websocket服务
@@ -65,9 +60,18 @@ func RegisterWebsocket(authLevel uint, path string, updater *websocket.Upgrader,
 	onClose interface{},
 	decoder func(data interface{}) (action string, request *map[string]interface{}, err error),
 	encoder func(action string, data interface{}) interface{}) *ActionRegister {
+	return registerWebsocket(nil, authLevel, path, updater, onOpen, onClose, decoder, encoder)
+}
+
+func registerWebsocket(group *Group, authLevel uint, path string, updater *websocket.Upgrader,
+	onOpen interface{},
+	onClose interface{},
+	decoder func(data interface{}) (action string, request *map[string]interface{}, err error),
+	encoder func(action string, data interface{}) interface{}) *ActionRegister {
 
 	s := new(websocketServiceType)
 	s.authLevel = authLevel
+	s.group = group
 	if updater == nil {
 		s.updater = new(websocket.Upgrader)
 	} else {
@@ -123,24 +127,12 @@ func RegisterWebsocket(authLevel uint, path string, updater *websocket.Upgrader,
 		}
 	}
 
-	finder, err := regexp.Compile("\\{(.+?)\\}")
-	if err == nil {
-		keyName := regexp.QuoteMeta(path)
-		finds := finder.FindAllStringSubmatch(path, 20)
-		for _, found := range finds {
-			keyName = strings.Replace(keyName, regexp.QuoteMeta(found[0]), "(.+?)", 1)
-			s.pathArgs = append(s.pathArgs, found[1])
-		}
-		if len(s.pathArgs) > 0 {
-			s.pathMatcher, _ = regexp.Compile("^" + keyName + "$")
-			if err != nil {
-				log.Print("RegisterWebsocket	Compile	", err)
-			}
-			regexWebsocketServices[path] = s
-		}
-	}
-	if s.pathMatcher == nil {
-		websocketServices[path] = s
+	node, pathArgs, err := serviceRoutes.add(path)
+	if err != nil {
+		log.Print("RegisterWebsocket	Compile	", err)
+	} else {
+		s.pathArgs = pathArgs
+		getRouteServices(node).websocket = s
 	}
 
 	return &ActionRegister{websocketName: path, websocketServiceType: s}
@@ -178,7 +170,7 @@ func SetActionAuthChecker(authChecker func(authLevel uint, url *string, action *
 	webSocketActionAuthChecker = authChecker
 }
 
-func doWebsocketService(ws *websocketServiceType, request *http.Request, response *http.ResponseWriter, args *map[string]interface{}, headers *map[string]string, startTime *time.Time) {
+func doWebsocketService(rh *routeHandler, ws *websocketServiceType, request *http.Request, response *http.ResponseWriter, args *map[string]interface{}, headers *map[string]string, startTime *time.Time) {
 	byteArgs, _ := json.Marshal(*args)
 	byteHeaders, _ := json.Marshal(*headers)
 
@@ -197,6 +189,12 @@ func doWebsocketService(ws *websocketServiceType, request *http.Request, respons
 	}
 
 	if err == nil {
+		rh.addWsConn(client)
+		defer func() {
+			rh.removeWsConn(client)
+			client.Close()
+		}()
+
 		var sessionValue reflect.Value
 		if ws.openFuncType != nil {
 			var openParms = make([]reflect.Value, ws.openParmsNum)
@@ -275,7 +273,7 @@ func doWebsocketService(ws *websocketServiceType, request *http.Request, respons
 				startTime := time.Now()
 				err = doWebsocketAction(ws, action, client, request, messageData, sessionValue)
 				if recordLogs {
-					usedTime := time.Now().UnixNano() - startTime.UnixNano()
+					usedTime := float32(time.Now().UnixNano()-startTime.UnixNano()) / 1e6
 					if err == nil {
 						log.Printf("WSACTION	%s	%s	%s	%.6f	%s", request.RemoteAddr, request.RequestURI, actionName, usedTime, string(printableMsg))
 					} else {
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// 使用 sclient 标签运行服务包，由服务在启动时根据已注册的服务生成客户端代码
+// 例如 sclient -o ./userclient/client.go ./user
+func main() {
+	app := flag.String("app", "", "app name used by client, default is the app config of service")
+	packageName := flag.String("package", "", "package name of client, default is the directory name of output")
+	output := flag.String("o", "", "output file")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sclient [-app name] [-package name] -o output.go [service package]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *output == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	servicePackage := "."
+	if flag.NArg() == 1 {
+		servicePackage = flag.Arg(0)
+	}
+
+	outputFile, err := filepath.Abs(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	startTime := time.Now()
+	cmd := exec.Command("go", "run", "-tags", "sclient", servicePackage)
+	cmd.Env = append(os.Environ(), "S_CLIENT_FILE="+outputFile, "S_CLIENT_APP="+*app, "S_CLIENT_PACKAGE="+*packageName)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if info, err := os.Stat(outputFile); err != nil || info.ModTime().Before(startTime) {
+		fmt.Fprintln(os.Stderr, "service exited without generating client, make sure it calls s.Start or s.Start1")
+		os.Exit(1)
+	}
+	fmt.Println(outputFile)
+}
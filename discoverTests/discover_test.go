@@ -2,15 +2,29 @@ package main
 
 import (
 	".."
+	"context"
+	"fmt"
 	"github.com/ssgo/redis"
+	"io"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestBase(tt *testing.T) {
 	t := s.T(tt)
 
-	redis.GetRedis("discover:15").DEL("a1")
+	s.ResetAllSets()
+	if oldRegistry, exists := os.LookupEnv("SERVICE_REGISTRY"); exists {
+		defer os.Setenv("SERVICE_REGISTRY", oldRegistry)
+	} else {
+		defer os.Unsetenv("SERVICE_REGISTRY")
+	}
+	os.Setenv("SERVICE_REGISTRY", "memory")
 
 	s.Register(2, "/dc/s1", func() (out struct{ Name string }) {
 		out.Name = "s1"
@@ -59,3 +73,881 @@ func TestBase(tt *testing.T) {
 	//bd := as.Get("/bd", "Access-Token", "aabbcc").String()
 	//t.Test(r.Error == nil && strings.Contains(bd, "baidu"), "DC by rewrite baidu", r.Error, bd)
 }
+
+func TestNodeChurn(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	registry := s.NewMemoryRegistry()
+	s.SetRegistry(registry)
+
+	s.Register(0, "/whoami", func(request *http.Request) string {
+		return request.Host
+	})
+	s.Register(0, "/call/{app}", func(in struct{ App string }, c *s.Caller) string {
+		return c.Get(in.App, "/whoami").String()
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_WEIGHT", "1")
+	os.Setenv("SERVICE_CALLS", `{"b1": {}, "b2": {}}`)
+	os.Setenv("SERVICE_APP", "b1")
+	as1 := s.AsyncStart()
+	defer as1.Stop()
+	os.Setenv("SERVICE_APP", "b2")
+	as2 := s.AsyncStart()
+	defer as2.Stop()
+	as3 := s.AsyncStart()
+
+	r := as1.Get("/call/b1")
+	t.Test(r.Error == nil && r.String() == as1.Addr, "Call self", r.Error, r.String())
+
+	hits := map[string]int{}
+	for i := 0; i < 10; i++ {
+		hits[as1.Get("/call/b2").String()]++
+	}
+	t.Test(len(hits) == 2 && hits[as2.Addr] > 0 && hits[as3.Addr] > 0, "Balance between nodes", hits)
+
+	as3.Stop()
+	hits = map[string]int{}
+	for i := 0; i < 5; i++ {
+		hits[as1.Get("/call/b2").String()]++
+	}
+	t.Test(len(hits) == 1 && hits[as2.Addr] == 5, "Stopped node removed", hits)
+
+	registry.Register("b2", "127.0.0.1:1", &s.RegistryNode{Weight: 1})
+	hits = map[string]int{}
+	for i := 0; i < 5; i++ {
+		hits[as1.Get("/call/b2").String()]++
+	}
+	t.Test(len(hits) == 1 && hits[as2.Addr] == 5, "Failover from dead node", hits)
+
+	as4 := s.AsyncStart()
+	defer as4.Stop()
+	hits = map[string]int{}
+	for i := 0; i < 10; i++ {
+		hits[as1.Get("/call/b2").String()]++
+	}
+	t.Test(hits[as4.Addr] > 0, "Restarted node discovered", hits)
+}
+
+func TestConcurrentChurn(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	registry := s.NewMemoryRegistry()
+	s.SetRegistry(registry)
+
+	s.Register(0, "/whoami", func(request *http.Request) string {
+		return request.Host
+	})
+	s.Register(0, "/call/{app}", func(in struct{ App string }, c *s.Caller) string {
+		return c.Get(in.App, "/whoami").String()
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"c1": {}}`)
+	os.Setenv("SERVICE_APP", "c1")
+	as1 := s.AsyncStart()
+	defer as1.Stop()
+	as2 := s.AsyncStart()
+	defer as2.Stop()
+
+	stopChan := make(chan bool)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stopChan:
+				return
+			default:
+			}
+			addr := fmt.Sprintf("127.0.0.1:%d", i%5+1)
+			registry.Register("c1", addr, &s.RegistryNode{Weight: i%3 + 1})
+			registry.Unregister("c1", addr)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	failed := int32(0)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				r := as1.Get("/call/c1").String()
+				if r != as1.Addr && r != as2.Addr {
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stopChan)
+	t.Test(failed == 0, "Concurrent calls while nodes changing", failed)
+}
+
+func TestRedisLease(tt *testing.T) {
+	t := s.T(tt)
+
+	registry, err := s.NewRedisRegistry("discover", "TEST_", 600)
+	if err != nil {
+		tt.Skip("No redis	", err)
+	}
+	rd := redis.GetRedis("discover")
+	rd.DEL("TEST_lease1", "TEST_LEASE_lease1", "TEST_META_lease1")
+
+	registry.Register("lease1", "127.0.0.1:1", &s.RegistryNode{Weight: 1})
+
+	// 重启的节点，旧的租约还未过期
+	rd.HSET("TEST_lease1", "127.0.0.1:3", 1)
+	rd.Do("ZADD", "TEST_LEASE_lease1", time.Now().UnixNano()/1e6+300, "127.0.0.1:3")
+	t.Test(registry.Register("lease1", "127.0.0.1:3", &s.RegistryNode{Weight: 1}), "Register existing addr")
+
+	// 没有心跳并且租约已过期的节点
+	rd.HSET("TEST_lease1", "127.0.0.1:2", 1)
+	rd.Do("ZADD", "TEST_LEASE_lease1", 1, "127.0.0.1:2")
+
+	unwatch := registry.Watch([]string{"lease1"}, func(app string, nodes map[string]*s.RegistryNode) {}, func(app, addr string, node *s.RegistryNode) {})
+	nodes := registry.Nodes("lease1")
+	t.Test(len(nodes) == 2 && nodes["127.0.0.1:1"] != nil && nodes["127.0.0.1:3"] != nil, "Expired node removed", nodes)
+
+	time.Sleep(time.Millisecond * 1000)
+	nodes = registry.Nodes("lease1")
+	t.Test(len(nodes) == 2 && nodes["127.0.0.1:1"] != nil && nodes["127.0.0.1:3"] != nil, "Lease refreshed by heartbeat", nodes)
+
+	unwatch()
+	registry.Unregister("lease1", "127.0.0.1:1")
+	registry.Unregister("lease1", "127.0.0.1:3")
+	nodes = registry.Nodes("lease1")
+	t.Test(len(nodes) == 0, "Unregistered", nodes)
+}
+
+func TestRegistryUnwatch(tt *testing.T) {
+	t := s.T(tt)
+
+	registry := s.NewMemoryRegistry()
+	onReset := func(app string, nodes map[string]*s.RegistryNode) {}
+	changes1, changes2 := 0, 0
+	unwatch1 := registry.Watch([]string{"w1"}, onReset, func(app, addr string, node *s.RegistryNode) { changes1++ })
+	unwatch2 := registry.Watch([]string{"w1"}, onReset, func(app, addr string, node *s.RegistryNode) { changes2++ })
+
+	registry.Register("w1", "127.0.0.1:1", &s.RegistryNode{Weight: 1})
+	unwatch1()
+	registry.Register("w1", "127.0.0.1:2", &s.RegistryNode{Weight: 1})
+	t.Test(changes1 == 1 && changes2 == 2, "Only stop own watcher", changes1, changes2)
+
+	unwatch2()
+	registry.Register("w1", "127.0.0.1:3", &s.RegistryNode{Weight: 1})
+	t.Test(changes2 == 2, "All watchers stopped", changes2)
+}
+
+func TestBreaker(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.SetRegistry(s.NewMemoryRegistry())
+
+	var badAddr atomic.Value
+	badAddr.Store("")
+	badHits := int32(0)
+	s.Register(0, "/flaky", func(request *http.Request, response http.ResponseWriter) string {
+		if request.Host == badAddr.Load().(string) {
+			atomic.AddInt32(&badHits, 1)
+			response.WriteHeader(503)
+		}
+		return request.Host
+	})
+	s.Register(0, "/call", func(c *s.Caller) string {
+		return c.Get("d1", "/flaky").String()
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"d1": {"breakFailures": 2, "breakTimeout": 300}}`)
+	os.Setenv("SERVICE_APP", "d1")
+	as1 := s.AsyncStart()
+	defer as1.Stop()
+	as2 := s.AsyncStart()
+	defer as2.Stop()
+
+	badAddr.Store(as2.Addr)
+	for i := 0; i < 10; i++ {
+		r := as1.Get("/call")
+		t.Test(r.String() == as1.Addr, "Failover to good node", r.String())
+	}
+	t.Test(atomic.LoadInt32(&badHits) == 2, "Break after failures", badHits)
+
+	badAddr.Store("")
+	time.Sleep(time.Millisecond * 350)
+	hits := map[string]int{}
+	for i := 0; i < 10; i++ {
+		hits[as1.Get("/call").String()]++
+	}
+	t.Test(hits[as2.Addr] > 0, "Recover after break timeout", hits)
+}
+
+func TestHealthCheck(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	registry := s.NewMemoryRegistry()
+	s.SetRegistry(registry)
+
+	var sickAddr atomic.Value
+	sickAddr.Store("")
+	s.Register(0, "/check", func(request *http.Request, response http.ResponseWriter) string {
+		if request.Host == sickAddr.Load().(string) {
+			response.WriteHeader(503)
+		}
+		return "OK"
+	})
+	s.Register(0, "/whoami", func(request *http.Request) string {
+		return request.Host
+	})
+	s.Register(0, "/call", func(c *s.Caller) string {
+		return c.Get("h1", "/whoami").String()
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"h1": {"healthInterval": 50, "healthFailures": 2, "healthPath": "/check"}}`)
+	os.Setenv("SERVICE_APP", "h1")
+	as1 := s.AsyncStart()
+	defer as1.Stop()
+	as2 := s.AsyncStart()
+	defer as2.Stop()
+
+	r := as1.Get("/_health")
+	t.Test(r.Error == nil && r.Response.StatusCode == 200, "Built-in health endpoint", r.Error, r.String())
+
+	sickAddr.Store(as2.Addr)
+	time.Sleep(time.Millisecond * 300)
+	hits := map[string]int{}
+	for i := 0; i < 10; i++ {
+		hits[as1.Get("/call").String()]++
+	}
+	t.Test(hits[as1.Addr] == 10, "Unhealthy node skipped", hits)
+	t.Test(len(registry.Nodes("h1")) == 2, "Unhealthy node still registered", registry.Nodes("h1"))
+
+	sickAddr.Store("")
+	time.Sleep(time.Millisecond * 300)
+	hits = map[string]int{}
+	for i := 0; i < 10; i++ {
+		hits[as1.Get("/call").String()]++
+	}
+	t.Test(hits[as2.Addr] > 0, "Recovered node called again", hits)
+}
+
+func TestHashRouting(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.SetRegistry(s.NewMemoryRegistry())
+
+	s.Register(0, "/whoami", func(request *http.Request) string {
+		return request.Host
+	})
+	s.Register(0, "/call", func(c *s.Caller) string {
+		return c.Get("e1", "/whoami").String()
+	})
+	s.Register(0, "/callWithKey/{key}", func(in struct{ Key string }, c *s.Caller) string {
+		return c.WithKey(in.Key).Get("e1", "/whoami").String()
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"e1": {"hashHeader": "X-User-Id"}}`)
+	os.Setenv("SERVICE_APP", "e1")
+	as1 := s.AsyncStart()
+	defer as1.Stop()
+	as2 := s.AsyncStart()
+	defer as2.Stop()
+	as3 := s.AsyncStart()
+	defer as3.Stop()
+
+	for _, user := range []string{"u1", "u2", "u3", "u4"} {
+		first := as1.Get("/call", "X-User-Id", user).String()
+		for i := 0; i < 5; i++ {
+			r := as1.Get("/call", "X-User-Id", user).String()
+			t.Test(r == first, "Same header same node", user, first, r)
+		}
+		keyFirst := as1.Get("/callWithKey/" + user).String()
+		r := as1.Get("/callWithKey/" + user).String()
+		t.Test(r == keyFirst, "Same key same node", user, keyFirst, r)
+	}
+}
+
+func TestMetaRouting(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.SetRegistry(s.NewMemoryRegistry())
+
+	s.Register(0, "/whoami", func(request *http.Request) string {
+		return request.Host
+	})
+	s.Register(0, "/filter/{conditions}", func(in struct{ Conditions string }, c *s.Caller) string {
+		r := c.WithFilter(in.Conditions).Get("m1", "/whoami")
+		if r.Error != nil {
+			return "error"
+		}
+		return r.String()
+	})
+	s.Register(0, "/prefer/{conditions}", func(in struct{ Conditions string }, c *s.Caller) string {
+		return c.WithPrefer(in.Conditions).Get("m1", "/whoami").String()
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"m1": {}}`)
+	os.Setenv("SERVICE_APP", "m1")
+	os.Setenv("SERVICE_META", `{"version": "1.0", "zone": "a"}`)
+	as1 := s.AsyncStart()
+	defer as1.Stop()
+	os.Setenv("SERVICE_META", `{"version": "2.1", "zone": "b", "tags": "gpu,ssd"}`)
+	as2 := s.AsyncStart()
+	defer as2.Stop()
+	os.Setenv("SERVICE_META", `{"version": "2.3", "zone": "a", "tags": "ssd"}`)
+	as3 := s.AsyncStart()
+	defer as3.Stop()
+	defer os.Unsetenv("SERVICE_META")
+
+	for i := 0; i < 10; i++ {
+		r := as1.Get("/filter/version=2.*").String()
+		t.Test(r == as2.Addr || r == as3.Addr, "Filter by version", r)
+
+		r = as1.Get("/filter/tags=gpu").String()
+		t.Test(r == as2.Addr, "Filter by tag", r)
+
+		// $zone 为当前服务自身的 zone（最后启动的 as3 为 a）
+		r = as1.Get("/prefer/zone=$zone").String()
+		t.Test(r == as1.Addr || r == as3.Addr, "Prefer local zone", r)
+
+		r = as1.Get("/prefer/zone=c").String()
+		t.Test(r == as1.Addr || r == as2.Addr || r == as3.Addr, "Prefer falls back to others", r)
+	}
+
+	r := as1.Get("/filter/version=3.*").String()
+	t.Test(r == "error", "No node matches filter", r)
+}
+
+func TestCanary(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	registry := s.NewMemoryRegistry()
+	s.SetRegistry(registry)
+	s.SetSessionKey("X-Session-Id")
+
+	s.Register(0, "/whoami", func(request *http.Request) string {
+		return request.Host
+	})
+	s.Register(0, "/call/{app}", func(in struct{ App string }, c *s.Caller) string {
+		return c.Get(in.App, "/whoami").String()
+	})
+	s.Proxy(0, "/proxy", "n1", "/whoami")
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"n1": {"canaryFilter": "version=2", "canaryPercent": 20}, "n2": {"canaryApp": "n3", "canaryHeader": "X-Beta", "canaryPercent": 50, "canarySticky": true}, "n4": {"canaryApp": "n5"}}`)
+	os.Setenv("SERVICE_APP", "n1")
+	os.Setenv("SERVICE_META", `{"version": "1"}`)
+	stable := s.AsyncStart()
+	defer stable.Stop()
+	os.Setenv("SERVICE_META", `{"version": "2"}`)
+	canary := s.AsyncStart()
+	defer canary.Stop()
+	os.Unsetenv("SERVICE_META")
+	os.Setenv("SERVICE_APP", "n2")
+	stable2 := s.AsyncStart()
+	defer stable2.Stop()
+	os.Setenv("SERVICE_APP", "n3")
+	canary2 := s.AsyncStart()
+	defer canary2.Stop()
+	os.Unsetenv("SERVICE_APP")
+
+	canaryTimes := 0
+	for i := 0; i < 200; i++ {
+		if stable.Get("/call/n1").String() == canary.Addr {
+			canaryTimes++
+		}
+	}
+	t.Test(canaryTimes > 10 && canaryTimes < 80, "Percentage split", canaryTimes)
+
+	for i := 0; i < 10; i++ {
+		r := stable.Get("/call/n1", "X-Canary", "1").String()
+		t.Test(r == canary.Addr, "Header forces canary", r)
+		r = stable.Get("/call/n1", "X-Canary", "0").String()
+		t.Test(r == stable.Addr, "Header forces stable", r)
+		r = stable.Get("/proxy", "X-Canary", "1").String()
+		t.Test(r == canary.Addr, "Header forces canary through proxy", r)
+		r = stable.Get("/call/n2", "X-Beta", "1").String()
+		t.Test(r == canary2.Addr, "Header forces canary app", r)
+	}
+
+	// 使用新的客户端，避免 AsyncServer 自动传递的 SessionId
+	client := s.GetClient()
+	counts := map[string]int{}
+	for i := 0; i < 20; i++ {
+		sessionId := fmt.Sprint("session-", i)
+		first := client.Get("http://"+stable.Addr+"/call/n2", "X-Session-Id", sessionId).String()
+		counts[first]++
+		for j := 0; j < 3; j++ {
+			r := client.Get("http://"+stable.Addr+"/call/n2", "X-Session-Id", sessionId).String()
+			t.Test(r == first, "Sticky per session", sessionId, first, r)
+		}
+	}
+	t.Test(counts[stable2.Addr] > 0 && counts[canary2.Addr] > 0, "Sessions split between versions", counts)
+
+	registry.Register("n4", stable2.Addr, &s.RegistryNode{Weight: 1})
+	registry.Register("n5", "127.0.0.1:1", &s.RegistryNode{Weight: 1})
+	for i := 0; i < 5; i++ {
+		r := stable.Get("/call/n4", "X-Canary", "1").String()
+		t.Test(r == stable2.Addr, "Fallback to stable when canary app is down", r)
+	}
+}
+
+func TestDeadline(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.SetRegistry(s.NewMemoryRegistry())
+
+	s.Register(0, "/remaining", func(request *http.Request, ctx context.Context) string {
+		_, hasDeadline := ctx.Deadline()
+		return fmt.Sprint(request.Header.Get("S-Timeout"), " ", hasDeadline)
+	})
+	s.Register(0, "/slow", func(ctx context.Context) string {
+		select {
+		case <-ctx.Done():
+			return "canceled"
+		case <-time.After(time.Second * 2):
+			return "finished"
+		}
+	})
+	s.Register(0, "/call/{path}", func(in struct{ Path string }, c *s.Caller) string {
+		r := c.Get("t1", "/"+in.Path)
+		if r.Error != nil {
+			return r.Error.Error()
+		}
+		return r.String()
+	})
+	s.Register(0, "/callCanceled", func(c *s.Caller) string {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r := c.WithContext(ctx).Get("t1", "/remaining")
+		return fmt.Sprint(r.Error)
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"t1": {}}`)
+	os.Setenv("SERVICE_APP", "t1")
+	as := s.AsyncStart()
+	defer as.Stop()
+
+	r := as.Get("/call/remaining").String()
+	t.Test(r == " false", "No deadline without header", r)
+
+	r = as.Get("/call/remaining", "S-Timeout", "300").String()
+	var remaining int
+	var hasDeadline bool
+	fmt.Sscan(r, &remaining, &hasDeadline)
+	t.Test(remaining > 0 && remaining <= 300 && hasDeadline, "Remaining deadline forwarded", r)
+
+	startTime := time.Now()
+	r = as.Get("/call/slow", "S-Timeout", "200").String()
+	usedTime := time.Since(startTime)
+	// 下游按传递的 deadline 结束，或者调用方先到达 deadline
+	t.Test((r == "canceled" || r == context.DeadlineExceeded.Error()) && usedTime < time.Second, "Downstream call ends at deadline", r, usedTime)
+
+	r = as.Get("/callCanceled").String()
+	t.Test(r == context.Canceled.Error(), "Canceled context", r)
+}
+
+func TestRetry(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.SetRegistry(s.NewMemoryRegistry())
+
+	var lock sync.Mutex
+	calls := map[string]int{}
+	keys := map[string]bool{}
+	s.Register(0, "/flaky/{name}/{failTimes}", func(in struct {
+		Name      string
+		FailTimes int
+	}, request *http.Request, response http.ResponseWriter) string {
+		lock.Lock()
+		defer lock.Unlock()
+		calls[in.Name]++
+		keys[request.Header.Get("Idempotency-Key")] = true
+		if calls[in.Name] <= in.FailTimes {
+			response.WriteHeader(503)
+		}
+		return "ok"
+	})
+	getCalls := func(name string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return calls[name]
+	}
+	s.Register(0, "/call/{app}/{method}/{name}/{failTimes}", func(in struct {
+		App       string
+		Method    string
+		Name      string
+		FailTimes int
+	}, c *s.Caller) string {
+		if in.Method == "IDEMPOTENT" {
+			in.Method = "POST"
+			c = c.WithIdempotencyKey("")
+		}
+		r := c.Do(in.Method, in.App, fmt.Sprint("/flaky/", in.Name, "/", in.FailTimes), nil)
+		return fmt.Sprint(r.Response.StatusCode)
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"r1": {"retryTimes": 3, "retryBackoff": 10, "breakFailures": 100}, "r2": {"retryTimes": 2, "retryBudget": 0.1, "breakFailures": 1000}}`)
+	os.Setenv("SERVICE_APP", "r1")
+	as := s.AsyncStart()
+	defer as.Stop()
+	os.Setenv("SERVICE_APP", "r2")
+	as2 := s.AsyncStart()
+	defer as2.Stop()
+	os.Unsetenv("SERVICE_APP")
+
+	startTime := time.Now()
+	r := as.Get("/call/r1/GET/get/2").String()
+	t.Test(r == "200" && getCalls("get") == 3, "GET retried with backoff", r, getCalls("get"))
+	t.Test(time.Since(startTime) < time.Second, "Backoff is short", time.Since(startTime))
+
+	r = as.Get("/call/r1/GET/exhausted/5").String()
+	t.Test(r == "503" && getCalls("exhausted") == 3, "Max attempts", r, getCalls("exhausted"))
+
+	r = as.Get("/call/r1/POST/post/2").String()
+	t.Test(r == "503" && getCalls("post") == 1, "POST not retried", r, getCalls("post"))
+
+	lock.Lock()
+	keys = map[string]bool{}
+	lock.Unlock()
+	r = as.Get("/call/r1/IDEMPOTENT/idempotent/2").String()
+	t.Test(r == "200" && getCalls("idempotent") == 3, "POST with idempotency key retried", r, getCalls("idempotent"))
+	lock.Lock()
+	t.Test(len(keys) == 1 && !keys[""], "Same idempotency key for each attempt", keys)
+	lock.Unlock()
+
+	for i := 0; i < 30; i++ {
+		as.Get(fmt.Sprint("/call/r2/GET/budget", i, "/100"))
+	}
+	totalCalls := 0
+	for i := 0; i < 30; i++ {
+		totalCalls += getCalls(fmt.Sprint("budget", i))
+	}
+	t.Test(totalCalls > 30 && totalCalls < 50, "Retry budget limits retries", totalCalls)
+}
+
+type hedgeCountLoadBalancer struct {
+	s.DefaultLoadBalancer
+	hedges int64
+}
+
+func (lb *hedgeCountLoadBalancer) Hedge(node, hedgeNode *s.NodeInfo) {
+	atomic.AddInt64(&lb.hedges, 1)
+}
+
+func TestHedge(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.SetRegistry(s.NewMemoryRegistry())
+	lb := &hedgeCountLoadBalancer{}
+	s.SetLoadBalancer(lb)
+
+	var slowAddr atomic.Value
+	slowAddr.Store("")
+	var canceledTimes int64
+	s.Register(0, "/maybeSlow", func(request *http.Request, ctx context.Context) string {
+		if request.Host == slowAddr.Load().(string) {
+			select {
+			case <-ctx.Done():
+				atomic.AddInt64(&canceledTimes, 1)
+			case <-time.After(time.Second):
+			}
+		}
+		return request.Host
+	})
+	s.Register(0, "/call/{method}", func(in struct{ Method string }, c *s.Caller) string {
+		return c.Do(in.Method, "g1", "/maybeSlow", nil).String()
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"g1": {"hedgeDelay": 50}}`)
+	os.Setenv("SERVICE_APP", "g1")
+	as1 := s.AsyncStart()
+	defer as1.Stop()
+	as2 := s.AsyncStart()
+	defer as2.Stop()
+	os.Unsetenv("SERVICE_APP")
+	slowAddr.Store(as1.Addr)
+
+	for i := 0; i < 6; i++ {
+		startTime := time.Now()
+		r := as2.Get("/call/GET").String()
+		usedTime := time.Since(startTime)
+		t.Test(r == as2.Addr && usedTime < time.Millisecond*500, "Fast node wins", r, usedTime)
+	}
+	hedges := atomic.LoadInt64(&lb.hedges)
+	t.Test(hedges > 0, "Hedges reported to load balancer", hedges)
+
+	time.Sleep(time.Millisecond * 100)
+	t.Test(atomic.LoadInt64(&canceledTimes) == hedges, "Slow requests canceled", canceledTimes, hedges)
+
+	// POST 不在 retryMethods 中并且没有幂等键，不会对冲，需要等待慢节点
+	hedged := false
+	for i := 0; i < 4; i++ {
+		r := as2.Get("/call/POST").String()
+		if r != as1.Addr && r != as2.Addr {
+			t.Test(false, "POST response", r)
+		}
+		if atomic.LoadInt64(&lb.hedges) != hedges {
+			hedged = true
+		}
+	}
+	t.Test(!hedged, "POST not hedged", atomic.LoadInt64(&lb.hedges), hedges)
+}
+
+func TestFanOut(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.SetRegistry(s.NewMemoryRegistry())
+
+	s.Register(0, "/sleep/{ms}", func(in struct{ Ms int }, request *http.Request, ctx context.Context) string {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(in.Ms) * time.Millisecond):
+		}
+		return request.Header.Get("S-Unique-Id") + " " + request.Header.Get("Access-Token")
+	})
+	s.Register(0, "/fail", func(response http.ResponseWriter) string {
+		response.WriteHeader(500)
+		return "failed"
+	})
+	s.Register(0, "/fan/{mode}", func(in struct{ Mode string }, request *http.Request, c *s.Caller) []string {
+		var results []*s.Result
+		switch in.Mode {
+		case "all":
+			results = c.DoAll(0, false, s.Call{App: "f1", Path: "/sleep/200"}, s.Call{App: "f1", Path: "/sleep/200"}, s.Call{App: "f1", Path: "/sleep/200"})
+		case "failFast":
+			results = c.DoAll(0, true, s.Call{App: "f1", Path: "/fail"}, s.Call{App: "f1", Path: "/sleep/1000"})
+		case "collectAll":
+			results = c.DoAll(0, false, s.Call{App: "f1", Path: "/fail"}, s.Call{App: "f1", Path: "/sleep/300"})
+		case "timeout":
+			results = c.DoAll(time.Millisecond*100, false, s.Call{App: "f1", Path: "/sleep/10"}, s.Call{App: "f1", Path: "/sleep/1000"})
+		}
+		outs := []string{request.Header.Get("S-Unique-Id")}
+		for _, r := range results {
+			if r.Error != nil {
+				outs = append(outs, r.Error.Error())
+			} else {
+				outs = append(outs, r.String())
+			}
+		}
+		if statusErr, ok := results[0].Err().(*s.StatusError); ok && in.Mode == "collectAll" {
+			outs = append(outs, fmt.Sprint(statusErr.Code, " ", statusErr.Node))
+		}
+		return outs
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"f1": {"accessToken": "fanToken"}}`)
+	os.Setenv("SERVICE_APP", "f1")
+	as := s.AsyncStart()
+	defer as.Stop()
+	os.Unsetenv("SERVICE_APP")
+
+	var outs []string
+	startTime := time.Now()
+	as.Get("/fan/all").To(&outs)
+	usedTime := time.Since(startTime)
+	t.Test(len(outs) == 4 && usedTime < time.Millisecond*500, "Calls run concurrently", outs, usedTime)
+	for _, out := range outs[1:] {
+		t.Test(out == outs[0]+" fanToken", "Unique id and access token preserved", out, outs[0])
+	}
+
+	startTime = time.Now()
+	as.Get("/fan/failFast").To(&outs)
+	usedTime = time.Since(startTime)
+	t.Test(len(outs) == 3 && outs[1] == "failed" && outs[2] == context.Canceled.Error() && usedTime < time.Millisecond*500, "Fail fast", outs, usedTime)
+
+	as.Get("/fan/collectAll").To(&outs)
+	t.Test(len(outs) == 4 && outs[1] == "failed" && outs[2] == outs[0]+" fanToken", "Collect all", outs)
+	t.Test(outs[3] == "500 "+as.Addr, "Status error with node", outs)
+
+	startTime = time.Now()
+	as.Get("/fan/timeout").To(&outs)
+	usedTime = time.Since(startTime)
+	t.Test(len(outs) == 3 && outs[1] == outs[0]+" fanToken" && outs[2] == context.DeadlineExceeded.Error() && usedTime < time.Millisecond*500, "Overall deadline", outs, usedTime)
+}
+
+func TestStreamCall(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.SetRegistry(s.NewMemoryRegistry())
+
+	s.Register(0, "/upload", func(in struct{ Name string }) string {
+		return "Hello " + in.Name
+	})
+	s.Register(0, "/download", func(response http.ResponseWriter) {
+		for i := 0; i < 3; i++ {
+			response.Write([]byte(fmt.Sprint("chunk", i, ";")))
+			response.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond * 50)
+		}
+	})
+	s.Register(0, "/callUpload", func(c *s.Caller) string {
+		reader, writer := io.Pipe()
+		go func() {
+			writer.Write([]byte(`{"name": `))
+			writer.Write([]byte(`"Star"}`))
+			writer.Close()
+		}()
+		return c.DoStream("POST", "st1", "/upload", reader).String()
+	})
+	s.Register(0, "/callDownload", func(c *s.Caller) string {
+		r := c.DoStream("GET", "st1", "/download", nil)
+		defer r.Close()
+		chunks := []string{}
+		buf := make([]byte, 100)
+		for {
+			n, err := r.Body().Read(buf)
+			if n > 0 {
+				chunks = append(chunks, string(buf[:n]))
+			}
+			if err != nil {
+				break
+			}
+		}
+		return strings.Join(chunks, "|")
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"st1": {"timeout": 80}}`)
+	os.Setenv("SERVICE_APP", "st1")
+	as := s.AsyncStart()
+	defer as.Stop()
+	os.Unsetenv("SERVICE_APP")
+
+	r := as.Get("/callUpload").String()
+	t.Test(r == "Hello Star", "Stream request through Caller", r)
+
+	r = as.Get("/callDownload").String()
+	t.Test(r == "chunk0;|chunk1;|chunk2;", "Stream response longer than timeout through Caller", r)
+}
+
+func TestClientInterceptors(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.SetRegistry(s.NewMemoryRegistry())
+
+	var lock sync.Mutex
+	logs := []string{}
+	s.AddClientInterceptor(func(request *s.ClientRequest, next func(*s.ClientRequest) *s.Result) *s.Result {
+		request.Headers = append(request.Headers, "X-Trace", "trace-1")
+		startTime := time.Now()
+		r := next(request)
+		lock.Lock()
+		logs = append(logs, fmt.Sprint(request.App, " ", request.Method, " ", r.Response.StatusCode, " ", time.Since(startTime) > 0))
+		lock.Unlock()
+		return r
+	})
+	s.RegisterClientInterceptor("sign", func(request *s.ClientRequest, next func(*s.ClientRequest) *s.Result) *s.Result {
+		if strings.HasSuffix(request.Url, "/cached") {
+			return s.NewResult(200, []byte("from cache"))
+		}
+		request.Headers = append(request.Headers, "X-Sign", request.Method+" "+request.Url[strings.LastIndex(request.Url, "/"):])
+		return next(request)
+	})
+
+	s.Register(0, "/echo", func(request *http.Request) string {
+		return request.Header.Get("X-Trace") + "," + request.Header.Get("X-Sign")
+	})
+	s.Register(0, "/call/{app}/{path}", func(in struct{ App, Path string }, c *s.Caller) string {
+		return c.Get(in.App, "/"+in.Path).String()
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"i1": {"interceptors": "sign"}, "i2": {}}`)
+	os.Setenv("SERVICE_APP", "i1")
+	as1 := s.AsyncStart()
+	defer as1.Stop()
+	os.Setenv("SERVICE_APP", "i2")
+	as2 := s.AsyncStart()
+	defer as2.Stop()
+	os.Unsetenv("SERVICE_APP")
+
+	r := as1.Get("/call/i1/echo").String()
+	t.Test(r == "trace-1,GET /echo", "Global and app interceptors", r)
+
+	r = as1.Get("/call/i2/echo").String()
+	t.Test(r == "trace-1,", "App interceptor only for its app", r)
+
+	r = as1.Get("/call/i1/cached").String()
+	t.Test(r == "from cache", "Short-circuit with synthetic result", r)
+
+	lock.Lock()
+	hasAppLog := false
+	for _, l := range logs {
+		if l == "i1 GET 200 true" {
+			hasAppLog = true
+		}
+	}
+	lock.Unlock()
+	t.Test(hasAppLog, "Interceptor sees app, method, response and timing", logs)
+}
+
+func TestHedgedInterceptors(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.SetRegistry(s.NewMemoryRegistry())
+
+	s.AddClientInterceptor(func(request *s.ClientRequest, next func(*s.ClientRequest) *s.Result) *s.Result {
+		request.Headers = append(request.Headers, "X-Target", strings.SplitN(request.Url, "/", 4)[2])
+		return next(request)
+	})
+
+	var slowAddr atomic.Value
+	slowAddr.Store("")
+	mismatches := int32(0)
+	s.Register(0, "/target", func(request *http.Request, ctx context.Context) string {
+		if targets := request.Header["X-Target"]; len(targets) != 1 || targets[0] != request.Host {
+			atomic.AddInt32(&mismatches, 1)
+		}
+		if request.Host == slowAddr.Load().(string) {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Millisecond * 200):
+			}
+		}
+		return request.Host
+	})
+	s.Register(0, "/call", func(c *s.Caller) string {
+		// 有剩余容量的 headers，拦截器 append 时可能写入共用的数组
+		headers := make([]string, 0, 20)
+		headers = append(headers, "X-Call", "1")
+		return c.Get("hi1", "/target", headers...).String()
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	os.Setenv("SERVICE_CALLS", `{"hi1": {"hedgeDelay": 10}}`)
+	os.Setenv("SERVICE_APP", "hi1")
+	as1 := s.AsyncStart()
+	defer as1.Stop()
+	as2 := s.AsyncStart()
+	defer as2.Stop()
+	os.Unsetenv("SERVICE_APP")
+	slowAddr.Store(as1.Addr)
+
+	for i := 0; i < 10; i++ {
+		r := as2.Get("/call").String()
+		t.Test(r == as1.Addr || r == as2.Addr, "Hedged call", r)
+	}
+	t.Test(atomic.LoadInt32(&mismatches) == 0, "Each attempt has its own headers", mismatches)
+}
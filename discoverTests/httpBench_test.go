@@ -2,6 +2,7 @@ package main
 
 import (
 	".."
+	"fmt"
 	"os"
 	"testing"
 )
@@ -42,3 +43,41 @@ func benchmarkForHttpClient(tb *testing.B, httpVersion int) {
 	})
 	tb.StopTimer()
 }
+
+func BenchmarkForRoutes10(tb *testing.B) {
+	benchmarkForRoutes(tb, 10)
+}
+
+func BenchmarkForRoutes5000(tb *testing.B) {
+	benchmarkForRoutes(tb, 5000)
+}
+
+// 路由数量增加时查找的耗时不应该线性增长
+func benchmarkForRoutes(tb *testing.B, routesNum int) {
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	tb.StopTimer()
+	s.ResetAllSets()
+	for i := 0; i < routesNum; i++ {
+		path := fmt.Sprintf("/r%d/items/{id}", i)
+		s.Register(0, path, func(in struct{ Id string }) string {
+			return in.Id
+		})
+		s.Register(0, path+"/info", func() string {
+			return "info"
+		})
+	}
+	as := s.AsyncStart()
+	defer as.Stop()
+
+	lastPath := fmt.Sprintf("/r%d/items/100", routesNum-1)
+	tb.StartTimer()
+	tb.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r := as.Get(lastPath)
+			if r.Error != nil || r.String() != "100" {
+				tb.Error("Routes Benchmark", r.Error, r.String())
+			}
+		}
+	})
+	tb.StopTimer()
+}
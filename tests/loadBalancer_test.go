@@ -0,0 +1,90 @@
+package tests
+
+import (
+	".."
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRoundRobinLoadBalancer(tt *testing.T) {
+	t := s.T(tt)
+	lb := &s.RoundRobinLoadBalancer{}
+	nodes := []*s.NodeInfo{{Addr: "a", Weight: 1}, {Addr: "b", Weight: 2}}
+
+	hits := map[string]int{}
+	for i := 0; i < 30; i++ {
+		hits[lb.Next(nodes, nil).Addr]++
+	}
+	t.Test(hits["a"] == 10 && hits["b"] == 20, "Weighted round robin", hits)
+}
+
+func TestLeastRequestingLoadBalancer(tt *testing.T) {
+	t := s.T(tt)
+	lb := &s.LeastRequestingLoadBalancer{}
+	nodes := []*s.NodeInfo{{Addr: "a", Weight: 1, Requesting: 3}, {Addr: "b", Weight: 2, Requesting: 4}, {Addr: "c", Weight: 1, Requesting: 5}}
+	t.Test(lb.Next(nodes, nil).Addr == "b", "Least requesting by weight")
+
+	nodes[1].Requesting = 6
+	t.Test(lb.Next(nodes, nil).Addr == "a", "Least requesting after change")
+}
+
+func TestP2CLoadBalancer(tt *testing.T) {
+	t := s.T(tt)
+	lb := &s.P2CLoadBalancer{}
+	nodes := []*s.NodeInfo{{Addr: "a", Weight: 1, Requesting: 10}, {Addr: "b", Weight: 1, Requesting: 1}}
+	for i := 0; i < 10; i++ {
+		t.Test(lb.Next(nodes, nil).Addr == "b", "Power of two choices")
+	}
+}
+
+func TestEWMALoadBalancer(tt *testing.T) {
+	t := s.T(tt)
+	lb := &s.EWMALoadBalancer{}
+	nodes := []*s.NodeInfo{{Addr: "a", Weight: 1}, {Addr: "b", Weight: 1}}
+
+	lb.Response(nodes[0], nil, nil, 5e6)
+	t.Test(lb.Next(nodes, nil).Addr == "b", "New node first")
+
+	lb.Response(nodes[1], nil, nil, 20e6)
+	t.Test(lb.Next(nodes, nil).Addr == "a", "Faster node")
+
+	lb.Response(nodes[0], errors.New("failed"), nil, 1e6)
+	t.Test(lb.Next(nodes, nil).Addr == "b", "Failed node penalized")
+
+	lb = &s.EWMALoadBalancer{DecayTime: time.Millisecond * 50}
+	lb.Response(nodes[0], errors.New("failed"), nil, 1e6)
+	lb.Response(nodes[1], nil, nil, 20e6)
+	t.Test(lb.Next(nodes, nil).Addr == "b", "Failed node penalized")
+	time.Sleep(time.Millisecond * 500)
+	lb.Response(nodes[1], nil, nil, 20e6)
+	t.Test(lb.Next(nodes, nil).Addr == "a", "Failed node recovered after decay")
+}
+
+func TestConsistentHashLoadBalancer(tt *testing.T) {
+	t := s.T(tt)
+	lb := &s.ConsistentHashLoadBalancer{}
+	nodes := []*s.NodeInfo{{Addr: "a", Weight: 1}, {Addr: "b", Weight: 1}, {Addr: "c", Weight: 1}, {Addr: "d", Weight: 1}}
+
+	before := map[string]string{}
+	hits := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("user-", i)
+		before[key] = lb.NextByKey(nodes, key).Addr
+		hits[before[key]]++
+		if lb.NextByKey(nodes, key).Addr != before[key] {
+			t.Test(false, "Same key same node", key)
+		}
+	}
+	t.Test(hits["a"] > 150 && hits["b"] > 150 && hits["c"] > 150 && hits["d"] > 150, "Keys spread over nodes", hits)
+
+	moved := 0
+	for key, addr := range before {
+		newAddr := lb.NextByKey(nodes[1:], key).Addr
+		if addr != "a" && newAddr != addr {
+			moved++
+		}
+	}
+	t.Test(moved == 0, "Only keys on removed node remapped", moved)
+}
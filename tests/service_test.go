@@ -2,9 +2,22 @@ package tests
 
 import (
 	".."
+	"bufio"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEchos(tt *testing.T) {
@@ -200,3 +213,447 @@ func BenchmarkEchosForMap(tb *testing.B) {
 
 	}
 }
+
+func TestGracefulStop(tt *testing.T) {
+	t := s.T(tt)
+	s.ResetAllSets()
+	s.Register(0, "/slow", func() string {
+		time.Sleep(time.Millisecond * 300)
+		return "done"
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	as := s.AsyncStart()
+
+	resultChan := make(chan *s.Result)
+	go func() {
+		resultChan <- as.Get("/slow")
+	}()
+	time.Sleep(time.Millisecond * 100)
+	as.Stop()
+
+	r := <-resultChan
+	t.Test(r.Error == nil && r.String() == "done", "Finish requesting when stop", r.Error, r.String())
+}
+
+func TestGracefulStopWithKeepAlive(tt *testing.T) {
+	t := s.T(tt)
+	s.ResetAllSets()
+	s.Register(0, "/slow", func() string {
+		time.Sleep(time.Millisecond * 300)
+		return "done"
+	})
+	s.Register(0, "/fast", func() string {
+		return "done"
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	as := s.AsyncStart1()
+
+	// 空闲的长连接
+	conn, err := net.Dial("tcp", as.Addr)
+	t.Test(err == nil, "Connect", err)
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("GET /fast HTTP/1.1\r\nHost: " + as.Addr + "\r\n\r\n"))
+	response, err := http.ReadResponse(reader, nil)
+	t.Test(err == nil && response.StatusCode == 200 && !response.Close, "Keep-alive request", err)
+	ioutil.ReadAll(response.Body)
+
+	resultChan := make(chan *s.Result)
+	go func() {
+		resultChan <- as.Get("/slow")
+	}()
+	time.Sleep(time.Millisecond * 100)
+	as.Stop()
+
+	r := <-resultChan
+	t.Test(r.Error == nil && r.String() == "done", "Finish requesting when stop", r.Error, r.String())
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = reader.ReadByte()
+	t.Test(err == io.EOF, "Idle keep-alive connection closed", err)
+	conn.Close()
+}
+
+func TestStream(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.Register(0, "/upload", func(in struct{ Name string }) string {
+		return "Hello " + in.Name
+	})
+	s.Register(0, "/download", func(response http.ResponseWriter) {
+		for i := 0; i < 3; i++ {
+			response.Write([]byte(fmt.Sprint("chunk", i, ";")))
+			response.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond * 100)
+		}
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	as1 := s.AsyncStart1()
+	defer as1.Stop()
+	as2 := s.AsyncStart()
+	defer as2.Stop()
+
+	for _, tc := range []struct {
+		name   string
+		addr   string
+		client *s.ClientPool
+	}{{"h1", as1.Addr, s.GetClient1()}, {"h2c", as2.Addr, s.GetClient()}} {
+		reader, writer := io.Pipe()
+		go func() {
+			writer.Write([]byte(`{"name": `))
+			time.Sleep(time.Millisecond * 50)
+			writer.Write([]byte(`"Star"}`))
+			writer.Close()
+		}()
+		r := tc.client.DoStream("POST", "http://"+tc.addr+"/upload", reader)
+		t.Test(r.Error == nil && r.String() == "Hello Star", "["+tc.name+"] Stream request body", r.Error, r.String())
+
+		startTime := time.Now()
+		r = tc.client.DoStream("GET", "http://"+tc.addr+"/download", nil)
+		t.Test(r.Error == nil, "["+tc.name+"] Stream response", r.Error)
+		buf := make([]byte, 100)
+		n, _ := r.Body().Read(buf)
+		usedTime := time.Since(startTime)
+		t.Test(string(buf[:n]) == "chunk0;" && usedTime < time.Millisecond*200, "["+tc.name+"] Read first chunk before response ends", string(buf[:n]), usedTime)
+		rest, _ := ioutil.ReadAll(r.Body())
+		r.Close()
+		t.Test(string(rest) == "chunk1;chunk2;", "["+tc.name+"] Read rest chunks", string(rest))
+	}
+}
+
+func TestResultErrors(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.Register(0, "/user", func() (out struct{ Name string }) {
+		out.Name = "Star"
+		return
+	})
+	s.Register(0, "/badRequest", func(response http.ResponseWriter) string {
+		response.WriteHeader(400)
+		return `{"code": 400, "message": "bad name"}`
+	})
+	s.Register(0, "/error", func(response http.ResponseWriter) string {
+		response.WriteHeader(500)
+		return "oops"
+	})
+	s.Register(0, "/text", func() string {
+		return "not json"
+	})
+	s.Register(0, "/weak", func() string {
+		return `{"name": "Star", "age": "12"}`
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	as := s.AsyncStart()
+	defer as.Stop()
+
+	var user struct{ Name string }
+	r := as.Get("/user")
+	t.Test(r.Err() == nil, "No error for 2xx", r.Err())
+	err := r.StrictTo(&user)
+	t.Test(err == nil && user.Name == "Star", "Strict decode", err, user)
+
+	r = as.Get("/badRequest")
+	statusErr, ok := r.Err().(*s.StatusError)
+	t.Test(ok && statusErr.Code == 400 && statusErr.Message == "bad name", "Standard error body", r.Err())
+	user.Name = ""
+	t.Test(r.StrictTo(&user) != nil && user.Name == "", "Strict decode fails on 4xx", user)
+	t.Test(r.To(&user) == nil, "To still decodes error body", user)
+
+	r = as.Get("/error")
+	statusErr, ok = r.Err().(*s.StatusError)
+	t.Test(ok && statusErr.Code == 500 && statusErr.Message == "oops" && string(statusErr.Body) == "oops", "Plain error body", r.Err())
+
+	var m map[string]interface{}
+	err = as.Get("/text").StrictTo(&m)
+	t.Test(err != nil, "Strict decode fails on bad JSON", err)
+
+	var person struct {
+		Name string
+		Age  int
+	}
+	err = as.Get("/weak").StrictTo(&person)
+	t.Test(err != nil, "Strict decode does not convert types", err, person)
+	var userId struct{ Id int }
+	err = as.Get("/user").StrictTo(&userId)
+	t.Test(err == nil && userId.Id == 0, "Strict decode ignores unknown fields", err)
+
+	user.Name = ""
+	r = s.GetClient().DoStream("GET", "http://"+as.Addr+"/user", nil)
+	err = r.StrictTo(&user)
+	t.Test(err == nil && user.Name == "Star", "Strict decode of stream result", err, user)
+
+	r = s.GetClient().Get("http://127.0.0.1:1/")
+	t.Test(r.Err() != nil && r.Err() == r.Error, "Transport error", r.Err())
+}
+
+func getFullName(in struct{ Name string }, c *s.Caller) (out struct{ FullName, Error string }) {
+	r := c.Post("user", "/"+in.Name+"/fullName", s.Map{"lang": "en"})
+	var user struct{ FullName string }
+	if err := r.StrictTo(&user); err != nil {
+		out.Error = err.Error()
+		return
+	}
+	out.FullName = user.FullName
+	return
+}
+
+func TestMock(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	mock := s.NewMock()
+	mock.Set("user", "/star/fullName", s.Map{"fullName": "Star Lee"})
+	mock.SetFunc("user", "", func(call *s.MockCall) *s.Result {
+		return s.NewResult(404, []byte(`{"code": 404, "message": "no user"}`))
+	})
+
+	out := getFullName(struct{ Name string }{"star"}, mock.Caller())
+	t.Test(out.FullName == "Star Lee", "Canned response", out)
+	out = getFullName(struct{ Name string }{"tom"}, mock.Caller())
+	t.Test(out.FullName == "" && out.Error != "", "Function response", out)
+
+	calls := mock.Calls()
+	t.Test(len(calls) == 2 && calls[0].App == "user" && calls[0].Method == "POST" && calls[0].Path == "/star/fullName", "Calls recorded", calls)
+	t.Test(calls[0].Data.(s.Map)["lang"] == "en", "Call data recorded", calls[0].Data)
+
+	// 通过 SetMock 测试启动的服务
+	mock.ResetCalls()
+	s.SetMock(mock)
+	s.Register(0, "/{name}", getFullName)
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	as := s.AsyncStart()
+	defer as.Stop()
+
+	d := as.Get("/star", "S-Unique-Id", "u-1").Map()
+	t.Test(d["fullName"] == "Star Lee", "Mock used by started service", d)
+	calls = mock.Calls()
+	t.Test(len(calls) == 1 && calls[0].Headers["S-Unique-Id"] == "u-1", "Headers recorded", calls)
+}
+
+type clientUserBase struct {
+	Id   int
+	Name string
+	age  int
+}
+
+type clientUser struct {
+	clientUserBase
+	Name string `json:"name"`
+}
+
+func TestMakeClient(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.Register(0, "/{name}/fullName", getFullName)
+	s.Register(0, "/files/{dir}", func(in s.Map) []byte { return nil })
+	s.Register(0, "/ping", func() {})
+	s.RegisterByMethod("DELETE", 0, "/users/{id}", func() {})
+	s.RegisterByMethod("GET", 0, "/orders/{id:int}/{rest:*}", func() {})
+	s.Register(0, "/userInfo", func(in clientUser) (out struct {
+		*clientUserBase
+		Tags []string
+	}) {
+		return
+	})
+
+	code, err := s.MakeClient("user", "userclient")
+	t.Test(err == nil, "Make client", err)
+	client := string(code)
+	t.Test(strings.Contains(client, "package userclient") && strings.Contains(client, `const App = "user"`), "Client package", client)
+	t.Test(strings.Contains(client, "func (c *Client) GetFullName(in GetFullNameIn, headers ...string) (out GetFullNameOut, err error)"), "Method from function name", client)
+	t.Test(strings.Contains(client, `"/"+url.PathEscape(fmt.Sprint(in.Name))+"/fullName"`), "Path args from in fields", client)
+	t.Test(strings.Contains(client, "type GetFullNameOut struct {\n\tFullName string\n\tError    string\n}"), "Out type", client)
+	t.Test(strings.Contains(client, "func (c *Client) FilesDir(in map[string]interface{}, headers ...string) (out []byte, err error)"), "Method from path", client)
+	t.Test(strings.Contains(client, "func (c *Client) Ping(headers ...string) error"), "Method without in and out", client)
+	t.Test(strings.Contains(client, `c.Caller.Do("DELETE", c.App, "/users/"+url.PathEscape(pathArg1), nil, headers...)`), "Request method and path arg without field", client)
+	t.Test(strings.Contains(client, `OrdersIdRest(pathArg1 int64, pathArg2 string, headers ...string) error`), "Typed path args", client)
+	t.Test(strings.Contains(client, `"/orders/"+url.PathEscape(fmt.Sprint(pathArg1))+"/"+pathArg2`), "Catch-all path arg", client)
+	t.Test(strings.Contains(client, "type clientUser struct {\n\tId   int\n\tName string `json:\"name\"`\n}"), "Unexported type with unexported embedded struct", client)
+	t.Test(strings.Contains(client, "type UserInfoOut struct {\n\tId   int\n\tName string\n\tTags []string\n}"), "Anonymous type with unexported embedded struct", client)
+
+	// 生成的代码需要能通过类型检查
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "client.go", code, 0)
+	t.Test(err == nil, "Parse client", err)
+	if err == nil {
+		conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+		_, err = conf.Check("userclient", fset, []*ast.File{file}, nil)
+		t.Test(err == nil, "Type check client", err, client)
+	}
+}
+
+func TestMethods(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.RegisterByMethod("GET", 0, "/items/{id}", func(in struct{ Id string }) string { return "get " + in.Id })
+	s.RegisterByMethod("post", 0, "/items/{id}", func(in struct{ Id string }) string { return "post " + in.Id })
+	s.RegisterByMethod("DELETE", 0, "/items", func() string { return "delete" })
+	s.Register(0, "/items", func() string { return "any" })
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	as := s.AsyncStart()
+	defer as.Stop()
+
+	r := as.Get("/items/1")
+	t.Test(r.String() == "get 1", "GET", r.String())
+	r = as.Post("/items/1", nil)
+	t.Test(r.String() == "post 1", "POST", r.String())
+
+	r = as.Put("/items/1", nil)
+	t.Test(r.Response.StatusCode == 405, "Not allowed", r.Response.StatusCode)
+	t.Test(r.Response.Header.Get("Allow") == "GET, HEAD, OPTIONS, POST", "Allow header", r.Response.Header.Get("Allow"))
+
+	r = as.Head("/items/1", nil)
+	t.Test(r.Response.StatusCode == 200 && len(r.Bytes()) == 0, "HEAD uses GET", r.Response.StatusCode, r.String())
+
+	r = as.Do("OPTIONS", "/items/1", nil)
+	t.Test(r.Response.StatusCode == 204 && r.Response.Header.Get("Allow") == "GET, HEAD, OPTIONS, POST", "OPTIONS", r.Response.StatusCode, r.Response.Header.Get("Allow"))
+
+	r = as.Delete("/items", nil)
+	t.Test(r.String() == "delete", "Method first", r.String())
+	r = as.Put("/items", nil)
+	t.Test(r.String() == "any", "All methods", r.String())
+}
+
+func TestGroups(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.SetAuthChecker(func(authLevel uint, url *string, in *map[string]interface{}, request *http.Request) bool {
+		switch request.Header.Get("Token") {
+		case "aaa":
+			return authLevel <= 1
+		case "bbb":
+			return authLevel <= 2
+		}
+		return false
+	})
+	echo := func(in map[string]interface{}) map[string]interface{} { return in }
+	s.Register(0, "/echo", echo)
+
+	api := s.NewGroup("/api", 1)
+	api.SetInFilter(func(in *map[string]interface{}, request *http.Request, response *http.ResponseWriter) interface{} {
+		(*in)["tags"] = "api"
+		return nil
+	})
+	api.SetOutFilter(func(in *map[string]interface{}, request *http.Request, response *http.ResponseWriter, result interface{}) (interface{}, bool) {
+		result.(map[string]interface{})["out"] = "api"
+		return nil, false
+	})
+	api.Register(0, "/echo", echo)
+	api.Register(2, "/admin", echo)
+	api.Proxy(0, "/proxy", "p1", "/echo")
+	s.Proxy(2, "/globalProxy", "p1", "/echo")
+
+	v1 := api.Group("/v1", 0)
+	v1.SetInFilter(func(in *map[string]interface{}, request *http.Request, response *http.ResponseWriter) interface{} {
+		(*in)["tags"] = (*in)["tags"].(string) + ",v1"
+		return nil
+	})
+	v1.SetOutFilter(func(in *map[string]interface{}, request *http.Request, response *http.ResponseWriter, result interface{}) (interface{}, bool) {
+		result.(map[string]interface{})["out"] = "v1"
+		return nil, false
+	})
+	v1.RegisterByMethod("GET", 0, "/echo/{id:int}", echo)
+	echoAR := v1.RegisterWebsocket(0, "/echoService/{token}/{roomId}", nil, OnEchoOpen, OnEchoClose, EchoDecoder, EchoEncoder)
+	echoAR.RegisterAction(0, "", OnEchoMessage)
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	as := s.AsyncStart1()
+	defer as.Stop()
+
+	d := as.Get("/echo").Map()
+	t.Test(d["tags"] == nil && d["out"] == nil, "Filters only in group", d)
+
+	r := as.Get("/api/echo")
+	t.Test(r.Response.StatusCode == 403, "Default auth level of group", r.Response.StatusCode)
+	d = as.Get("/api/echo", "Token", "aaa").Map()
+	t.Test(d["tags"] == "api" && d["out"] == "api", "Group filters", d)
+	r = as.Get("/api/admin", "Token", "aaa")
+	t.Test(r.Response.StatusCode == 403, "Auth level of route", r.Response.StatusCode)
+	r = as.Get("/api/admin", "Token", "bbb")
+	t.Test(r.Response.StatusCode == 200, "Auth level of route", r.Response.StatusCode)
+	r = as.Get("/api/proxy")
+	t.Test(r.Response.StatusCode == 403, "Proxy in group", r.Response.StatusCode)
+	r = as.Get("/globalProxy")
+	t.Test(r.Response.StatusCode != 403, "Global proxy without auth check", r.Response.StatusCode)
+
+	d = as.Get("/api/v1/echo/12", "Token", "aaa").Map()
+	t.Test(d["tags"] == "api,v1" && d["id"].(float64) == 12 && d["out"] == "api", "Nested group", d)
+	r = as.Get("/api/v1/echo/12")
+	t.Test(r.Response.StatusCode == 403, "Auth level of parent group", r.Response.StatusCode)
+
+	_, _, err := websocket.DefaultDialer.Dial("ws://"+as.Addr+"/api/v1/echoService/abc/99", nil)
+	t.Test(err != nil, "Websocket in group without token", err)
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+as.Addr+"/api/v1/echoService/abc/99", http.Header{"Token": []string{"aaa"}})
+	t.Test(err == nil, "Websocket in group", err)
+	c.Close()
+}
+
+func TestHandlerErrors(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.Register(0, "/user/{id:int}", func(in struct{ Id int }) (out struct{ Name string }, err error) {
+		if in.Id != 1 {
+			return out, s.NewHttpError(404, 40401, "user not found")
+		}
+		out.Name = "Star"
+		return
+	})
+	s.Register(0, "/check", func(in struct{ Name string }) *s.HttpError {
+		if in.Name == "" {
+			return s.NewHttpError(400, 0, "name required")
+		}
+		return nil
+	})
+	s.Register(0, "/fail", func() (string, error) {
+		return "", fmt.Errorf("db password wrong")
+	})
+	s.Register(0, "/teapot", func(response http.ResponseWriter) string {
+		response.WriteHeader(418)
+		return "teapot"
+	})
+	s.SetInFilter(func(in *map[string]interface{}, request *http.Request, response *http.ResponseWriter) interface{} {
+		if (*in)["blocked"] != nil {
+			return s.NewHttpError(429, 0, "too many requests")
+		}
+		return nil
+	})
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	as := s.AsyncStart()
+	defer as.Stop()
+
+	var user struct{ Name string }
+	r := as.Get("/user/1")
+	t.Test(r.StrictTo(&user) == nil && user.Name == "Star", "Result with nil error", r.Err(), user)
+
+	r = as.Get("/user/2")
+	statusErr, ok := r.Err().(*s.StatusError)
+	t.Test(ok && statusErr.Code == 404 && statusErr.Message == "user not found", "HttpError status and message", r.Err())
+	t.Test(r.Map()["code"] == float64(40401), "HttpError code", r.String())
+
+	r = as.Get("/check?name=abc")
+	t.Test(r.Response.StatusCode == 200 && r.Err() == nil, "Nil error only", r.Err())
+	r = as.Get("/check")
+	statusErr, ok = r.Err().(*s.StatusError)
+	t.Test(ok && statusErr.Code == 400 && statusErr.Message == "name required" && r.Map()["code"] == float64(400), "Error only", r.String())
+
+	r = as.Get("/fail")
+	statusErr, ok = r.Err().(*s.StatusError)
+	t.Test(ok && statusErr.Code == 500 && !strings.Contains(string(statusErr.Body), "password"), "Plain error hides message", r.String())
+
+	r = as.Get("/teapot")
+	t.Test(r.Response.StatusCode == 418 && r.String() == "teapot", "Status written by handler", r.Response.StatusCode)
+
+	r = as.Get("/check?blocked=1")
+	statusErr, ok = r.Err().(*s.StatusError)
+	t.Test(ok && statusErr.Code == 429 && statusErr.Message == "too many requests", "Error from filter", r.String())
+}
@@ -2,6 +2,9 @@ package tests
 
 import (
 	".."
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
@@ -82,3 +85,95 @@ func TestWelcomePicture(tt *testing.T) {
 	t.Test(r.Error == nil && result[0] == 1 && result[1] == 0 && result[2] == 240 && result[4] == 'b', "WelcomePicture", result, r.Error)
 	t.Test(r.Response.Header.Get("Content-Type") == "image/png", "WelcomePicture Content-Type", result, r.Error)
 }
+
+func TestRoutes(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.Register(0, "/users/{id}", func(in struct{ Id string }) string { return "user " + in.Id })
+	s.Register(0, "/users/me", func() string { return "me" })
+	s.Register(0, "/files/{name}.json", func(in struct{ Name string }) string { return "json " + in.Name })
+	s.Register(0, "/files/{file}", func(in struct{ File string }) string { return "file " + in.File })
+	s.Register(0, "/files/{dir}/info", func(in struct{ Dir string }) string { return "dir " + in.Dir })
+
+	wwwPath, _ := ioutil.TempDir("", "www")
+	defer os.RemoveAll(wwwPath)
+	os.MkdirAll(wwwPath+"/assets", 0755)
+	ioutil.WriteFile(wwwPath+"/assets/a.txt", []byte("root a"), 0644)
+	assetsPath, _ := ioutil.TempDir("", "assets")
+	defer os.RemoveAll(assetsPath)
+	os.MkdirAll(assetsPath+"/assets", 0755)
+	ioutil.WriteFile(assetsPath+"/assets/a.txt", []byte("assets a"), 0644)
+	s.Static("/", wwwPath)
+	s.Static("/assets/", assetsPath)
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	as := s.AsyncStart()
+	defer as.Stop()
+
+	r := as.Get("/users/me")
+	t.Test(r.String() == "me", "Static segment first", r.String())
+	r = as.Get("/users/100")
+	t.Test(r.String() == "user 100", "Param segment", r.String())
+	r = as.Get("/users/100/x")
+	t.Test(r.Response.StatusCode == 404, "Param only matches one segment", r.Response.StatusCode)
+
+	for i := 0; i < 20; i++ {
+		r = as.Get("/files/a.json")
+		t.Test(r.String() == "json a", "Param with text first", r.String())
+	}
+	r = as.Get("/files/a.txt")
+	t.Test(r.String() == "file a.txt", "Next param", r.String())
+	r = as.Get("/files/a/info")
+	t.Test(r.String() == "dir a", "Backtrack to deeper route", r.String())
+
+	r = as.Get("/assets/a.txt")
+	t.Test(r.String() == "assets a", "Longest static prefix", r.String())
+}
+
+func TestTypedRoutes(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.Register(0, "/items/{name}", func(in struct{ Name string }) string { return "name " + in.Name })
+	s.Register(0, "/items/{id:int}", func(in map[string]interface{}) string { return fmt.Sprintf("id %T %v", in["id"], in["id"]) })
+	s.Register(0, "/items/{slug:[a-z-]+}", func(in struct{ Slug string }) string { return "slug " + in.Slug })
+	s.Register(0, "/prices/{price:float}", func(in struct{ Price float64 }) string { return fmt.Sprint("price ", in.Price*2) })
+	s.Register(0, "/codes/{code:[0-9]{3}}", func(in struct{ Code string }) string { return "code " + in.Code })
+	s.Register(0, "/files/{path:*}", func(in struct{ Path string }) string { return "file " + in.Path })
+	s.Register(0, "/docs/{path:*}/info", func(in struct{ Path string }) string { return "doc " + in.Path })
+	echoAR := s.RegisterWebsocket(0, "/echoService/{token:[a-z]+}/{roomId:int}", nil, OnEchoOpen, OnEchoClose, EchoDecoder, EchoEncoder)
+	echoAR.RegisterAction(0, "", OnEchoMessage)
+
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+	as := s.AsyncStart1()
+	defer as.Stop()
+
+	r := as.Get("/items/12")
+	t.Test(r.String() == "id int64 12", "Int param", r.String())
+	r = as.Get("/items/a-b")
+	t.Test(r.String() == "slug a-b", "Regex param", r.String())
+	r = as.Get("/items/A_B")
+	t.Test(r.String() == "name A_B", "Fall through to plain param", r.String())
+	r = as.Get("/prices/1.5")
+	t.Test(r.String() == "price 3", "Float param", r.String())
+	r = as.Get("/prices/abc")
+	t.Test(r.Response.StatusCode == 404, "Bad float param", r.Response.StatusCode)
+	r = as.Get("/codes/123")
+	t.Test(r.String() == "code 123", "Regex with braces", r.String())
+	r = as.Get("/codes/1234")
+	t.Test(r.Response.StatusCode == 404, "Bad regex param", r.Response.StatusCode)
+	r = as.Get("/files/a/b/c.txt")
+	t.Test(r.String() == "file a/b/c.txt", "Catch-all param", r.String())
+	r = as.Get("/docs/a/info")
+	t.Test(r.Response.StatusCode == 404, "Catch-all param not at the end", r.Response.StatusCode, r.String())
+
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+as.Addr+"/echoService/abc/99", nil)
+	t.Test(err == nil, "Websocket with typed params", err)
+	data := make([]interface{}, 0)
+	c.ReadJSON(&data)
+	t.Test(len(data) == 2 && data[1].(map[string]interface{})["roomId"].(float64) == 99, "Websocket params", data)
+	c.Close()
+	_, _, err = websocket.DefaultDialer.Dial("ws://"+as.Addr+"/echoService/abc/x99", nil)
+	t.Test(err != nil, "Websocket with bad params", err)
+}
@@ -49,6 +49,60 @@ func TestEchoWS(tt *testing.T) {
 	c.Close()
 }
 
+func TestWSCloseWhenStop(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	echoAR := s.RegisterWebsocket(0, "/echoService/{token}/{roomId}", nil, OnEchoOpen, OnEchoClose, EchoDecoder, EchoEncoder)
+	echoAR.RegisterAction(0, "", OnEchoMessage)
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+
+	as := s.AsyncStart1()
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+as.Addr+"/echoService/abc-123/99", nil)
+	t.Test(err == nil, "Connect", err)
+
+	r := make([]interface{}, 0)
+	err = c.ReadJSON(&r)
+	t.Test(err == nil, "Read welcome", err)
+
+	stopChan := make(chan bool)
+	go func() {
+		as.Stop()
+		stopChan <- true
+	}()
+
+	err = c.ReadJSON(&r)
+	t.Test(websocket.IsCloseError(err, websocket.CloseGoingAway), "Receive close frame", err)
+	<-stopChan
+	c.Close()
+}
+
+func TestWSWithWebParamRoutes(tt *testing.T) {
+	t := s.T(tt)
+
+	s.ResetAllSets()
+	s.Register(0, "/{name}", func(in struct{ Name string }) string { return "name " + in.Name })
+	s.Register(0, "/{path:*}", func(in struct{ Path string }) string { return "path " + in.Path })
+	echoAR := s.RegisterWebsocket(0, "/ws", nil, OnEchoOpen, OnEchoClose, EchoDecoder, EchoEncoder)
+	echoAR.RegisterAction(0, "", OnEchoMessage)
+	os.Setenv("SERVICE_LOGFILE", os.DevNull)
+
+	as := s.AsyncStart1()
+	defer as.Stop()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+as.Addr+"/ws", nil)
+	t.Test(err == nil, "Static websocket route before web param route", err)
+	if err == nil {
+		r := make([]interface{}, 0)
+		err = c.ReadJSON(&r)
+		t.Test(err == nil && len(r) > 0 && r[0] == "welcome", "Read welcome", r, err)
+		c.Close()
+	}
+
+	t.Test(as.Get("/abc").String() == "name abc", "Web param route")
+	t.Test(as.Get("/ws/abc").String() == "path ws/abc", "Web catch-all route")
+}
+
 func BenchmarkWSEcho(b *testing.B) {
 	b.StopTimer()
 	s.ResetAllSets()